@@ -16,23 +16,24 @@ package gormadapter
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/casbin/casbin/v3"
 	"github.com/casbin/casbin/v3/model"
 	"github.com/casbin/casbin/v3/persist"
-	"github.com/glebarez/sqlite"
 	"github.com/pkg/errors"
-	"gorm.io/driver/mysql"
-	"gorm.io/driver/postgres"
-	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	"gorm.io/plugin/dbresolver"
 )
@@ -40,6 +41,7 @@ import (
 const (
 	defaultDatabaseName = "casbin"
 	defaultTableName    = "casbin_rule"
+	defaultFieldCount   = 6
 )
 
 const disableMigrateKey = "disableMigrateKey"
@@ -54,6 +56,9 @@ type CasbinRule struct {
 	V3    string `gorm:"size:100"`
 	V4    string `gorm:"size:100"`
 	V5    string `gorm:"size:100"`
+	// ExtraV holds the values of columns v6 and above,
+	// used when the adapter stores more than six value fields.
+	ExtraV []string `gorm:"-"`
 }
 
 func (CasbinRule) TableName() string {
@@ -68,29 +73,111 @@ type Filter struct {
 	V3    []string
 	V4    []string
 	V5    []string
+	// ExtraV[i] filters column v(6+i),
+	// used when the adapter stores more than six value fields.
+	ExtraV [][]string
+}
+
+// values returns the filters of the values of the rules, by index.
+func (f *Filter) values() [][]string {
+	return append([][]string{f.V0, f.V1, f.V2, f.V3, f.V4, f.V5}, f.ExtraV...)
 }
 
 type BatchFilter struct {
 	filters []Filter
 }
 
+// PredicateType represents the kind of condition a Predicate puts on a column.
+type PredicateType uint32
+
+const (
+	PredicateTypeEqual  PredicateType = iota // The column equals Values[0]
+	PredicateTypeIn                          // The column is one of Values
+	PredicateTypeNotIn                       // The column is none of Values
+	PredicateTypePrefix                      // The column starts with Values[0]
+	PredicateTypeLike                        // The column matches the LIKE pattern Values[0]
+	PredicateTypeEmpty                       // The column is empty
+	PredicateTypeRange                       // Values[0] <= column < Values[1], an empty bound is open
+)
+
+// Predicate is a condition on one column of the policy table.
+type Predicate struct {
+	Type   PredicateType
+	Values []string
+}
+
+// PredicateFilter filters the policy by predicates on its columns.
+// A rule is loaded if it matches every predicate.
+type PredicateFilter struct {
+	Ptype []Predicate
+	V0    []Predicate
+	V1    []Predicate
+	V2    []Predicate
+	V3    []Predicate
+	V4    []Predicate
+	V5    []Predicate
+	// ExtraV[i] filters column v(6+i),
+	// used when the adapter stores more than six value fields.
+	ExtraV [][]Predicate
+}
+
 // Adapter represents the Gorm adapter for policy storage.
 type Adapter struct {
 	driverName     string
 	dataSourceName string
 	databaseName   string
+	schema         string
 	tablePrefix    string
 	tableName      string
 	dbSpecified    bool
 	db             *gorm.DB
 	isFiltered     bool
+	fieldCount     int
+	columnSizes    ColumnSizes
+	strict         bool
+	exactMatch     bool
+	noOpErrors     bool
+	loadBatchSize  int
+	changeLogTable string
+	auditTable     string
+	softDelete     bool
+	snapshotTable  string
+	dryRun         *DryRunReport
+	definitions    atomic.Pointer[map[string]int]
 	transactionMu  *sync.Mutex
 	muInitialize   sync.Once
 }
 
+// RuleLengthError is returned in strict mode when a rule has more values than
+// the table has value columns or than its policy definition declares.
+type RuleLengthError struct {
+	Ptype string
+	Rule  []string
+	Limit int
+}
+
+func (e *RuleLengthError) Error() string {
+	return fmt.Sprintf("rule %v of ptype %s has %d values, but at most %d are allowed", e.Rule, e.Ptype, len(e.Rule), e.Limit)
+}
+
+var (
+	// ErrPolicyExists is returned when adding rules that are all stored already,
+	// if no-op errors are enabled, see EnableNoOpErrors.
+	ErrPolicyExists = errors.New("policy already exists")
+	// ErrPolicyNotFound is returned when removing or updating rules that match no stored rule,
+	// if no-op errors are enabled, see EnableNoOpErrors.
+	ErrPolicyNotFound = errors.New("policy not found")
+)
+
 var (
-	_ persist.Adapter      = (*Adapter)(nil)
-	_ persist.BatchAdapter = (*Adapter)(nil)
+	_ persist.Adapter                 = (*Adapter)(nil)
+	_ persist.BatchAdapter            = (*Adapter)(nil)
+	_ persist.FilteredAdapter         = (*Adapter)(nil)
+	_ persist.UpdatableAdapter        = (*Adapter)(nil)
+	_ persist.ContextAdapter          = (*Adapter)(nil)
+	_ persist.ContextBatchAdapter     = (*Adapter)(nil)
+	_ persist.ContextFilteredAdapter  = (*Adapter)(nil)
+	_ persist.ContextUpdatableAdapter = (*Adapter)(nil)
 )
 
 // finalizer is the destructor for Adapter.
@@ -185,6 +272,9 @@ func NewAdapter(driverName string, dataSourceName string, params ...interface{})
 	} else if len(params) != 0 {
 		return nil, errors.New("too many parameters")
 	}
+	if err := a.checkNames(); err != nil {
+		return nil, err
+	}
 
 	// Open the DB, create it if not existed.
 	err := a.Open()
@@ -201,18 +291,52 @@ func NewAdapter(driverName string, dataSourceName string, params ...interface{})
 // NewAdapterByDBUseTableName creates gorm-adapter by an existing Gorm instance and the specified table prefix and table name
 // Example: gormadapter.NewAdapterByDBUseTableName(&db, "cms", "casbin") Automatically generate table name like this "cms_casbin"
 func NewAdapterByDBUseTableName(db *gorm.DB, prefix string, tableName string) (*Adapter, error) {
+	return newAdapterByDB(db, "", prefix, tableName, 0, ColumnSizes{})
+}
+
+// NewAdapterByDBWithFieldCount creates gorm-adapter by an existing Gorm instance whose table
+// stores fieldCount value columns (v0 to v{fieldCount-1}) instead of the default six.
+// Example: gormadapter.NewAdapterByDBWithFieldCount(db, "", "casbin_rule", 12) stores rules with up to 12 values.
+func NewAdapterByDBWithFieldCount(db *gorm.DB, prefix string, tableName string, fieldCount int) (*Adapter, error) {
+	if fieldCount < 1 {
+		return nil, errors.New("fieldCount must be greater than 0")
+	}
+	return newAdapterByDB(db, "", prefix, tableName, fieldCount, ColumnSizes{})
+}
+
+// NewAdapterByDBWithColumnSizes creates gorm-adapter by an existing Gorm instance whose table
+// has columns of the given sizes instead of the default 100 characters.
+// Use WidenColumns to widen the columns of an existing table.
+// Example: gormadapter.NewAdapterByDBWithColumnSizes(db, "", "casbin_rule", gormadapter.ColumnSizes{Value: 1000})
+func NewAdapterByDBWithColumnSizes(db *gorm.DB, prefix string, tableName string, sizes ColumnSizes) (*Adapter, error) {
+	if sizes.Ptype < 0 || sizes.Value < 0 {
+		return nil, errors.New("column sizes must not be negative")
+	}
+	return newAdapterByDB(db, "", prefix, tableName, 0, sizes)
+}
+
+func newAdapterByDB(db *gorm.DB, schema string, prefix string, tableName string, fieldCount int, sizes ColumnSizes) (*Adapter, error) {
 	if len(tableName) == 0 {
 		tableName = defaultTableName
 	}
 
 	a := &Adapter{
+		schema:        schema,
 		tablePrefix:   prefix,
 		tableName:     tableName,
+		fieldCount:    fieldCount,
+		columnSizes:   sizes,
 		transactionMu: &sync.Mutex{},
 	}
+	if err := a.checkNames(); err != nil {
+		return nil, err
+	}
 
 	a.db = db.Scopes(a.casbinRuleTable()).Session(&gorm.Session{Context: db.Statement.Context})
 
+	if err := a.createSchema(); err != nil {
+		return nil, err
+	}
 	err := a.createTable()
 	if err != nil {
 		return nil, err
@@ -265,12 +389,18 @@ func NewFilteredAdapter(driverName string, dataSourceName string, params ...inte
 // NewFilteredAdapterByDB is the constructor for FilteredAdapter.
 // Casbin will not automatically call LoadPolicy() for a filtered adapter.
 func NewFilteredAdapterByDB(db *gorm.DB, prefix string, tableName string) (*Adapter, error) {
+	if len(tableName) == 0 {
+		tableName = defaultTableName
+	}
 	adapter := &Adapter{
 		tablePrefix:   prefix,
 		tableName:     tableName,
 		isFiltered:    true,
 		transactionMu: &sync.Mutex{},
 	}
+	if err := adapter.checkNames(); err != nil {
+		return nil, err
+	}
 	adapter.db = db.Scopes(adapter.casbinRuleTable()).Session(&gorm.Session{Context: db.Statement.Context})
 
 	return adapter, nil
@@ -317,83 +447,57 @@ func NewAdapterByDBWithCustomTable(db *gorm.DB, t interface{}, tableName ...stri
 		curTableName = tableName[0]
 	}
 
-	return NewAdapterByDBUseTableName(db.WithContext(ctx), "", curTableName)
+	return newAdapterByDB(db.WithContext(ctx), "", "", curTableName, countValueFields(t), ColumnSizes{})
 }
 
 func openDBConnection(driverName, dataSourceName string) (*gorm.DB, error) {
-	var err error
-	var db *gorm.DB
-	config := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent),
-	}
-	if driverName == "postgres" {
-		db, err = gorm.Open(postgres.Open(dataSourceName), config)
-	} else if driverName == "mysql" {
-		db, err = gorm.Open(mysql.Open(dataSourceName), config)
-	} else if driverName == "sqlserver" {
-		db, err = gorm.Open(sqlserver.Open(dataSourceName), config)
-	} else if driverName == "sqlite3" {
-		db, err = gorm.Open(sqlite.Open(dataSourceName), config)
-	} else {
-		return nil, errors.New("Database dialect '" + driverName + "' is not supported. Supported databases are postgres, mysql, sqlserver and sqlite3")
-	}
+	d, err := lookupDialect(driverName)
 	if err != nil {
 		return nil, err
 	}
-	return db, err
+	config := &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	}
+	return gorm.Open(d.Open(dataSourceName), config)
 }
 
 func (a *Adapter) createDatabase() error {
-	var err error
 	db, err := openDBConnection(a.driverName, a.dataSourceName)
 	if err != nil {
 		return err
 	}
-	if a.driverName == "postgres" {
-		if err = db.Exec("CREATE DATABASE " + a.databaseName).Error; err != nil {
-			// 42P04 is	duplicate_database
-			if strings.Contains(fmt.Sprintf("%s", err), "42P04") {
-				return nil
-			}
-		}
-	} else if a.driverName != "sqlite3" && a.driverName != "sqlserver" {
-		err = db.Exec("CREATE DATABASE IF NOT EXISTS " + a.databaseName).Error
-	}
+	return dialectOf(db, a.driverName).CreateDatabase(db, a.databaseName)
+}
+
+func (a *Adapter) Open() error {
+	db, err := a.openDB()
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (a *Adapter) Open() error {
-	var err error
-	var db *gorm.DB
+	a.db = db.Scopes(a.casbinRuleTable()).Session(&gorm.Session{})
+	return a.createTable()
+}
 
+// openDB opens the database of the driver and data source of the adapter,
+// creating it first unless the data source specifies it.
+func (a *Adapter) openDB() (*gorm.DB, error) {
 	if a.dbSpecified {
-		db, err = openDBConnection(a.driverName, a.dataSourceName)
-		if err != nil {
-			return err
-		}
-	} else {
-		if err = a.createDatabase(); err != nil {
-			return err
-		}
-		if a.driverName == "postgres" {
-			db, err = openDBConnection(a.driverName, a.dataSourceName+" dbname="+a.databaseName)
-		} else if a.driverName == "sqlite3" {
-			db, err = openDBConnection(a.driverName, a.dataSourceName)
-		} else if a.driverName == "sqlserver" {
-			db, err = openDBConnection(a.driverName, a.dataSourceName+"?database="+a.databaseName)
-		} else {
-			db, err = openDBConnection(a.driverName, a.dataSourceName+a.databaseName)
-		}
-		if err != nil {
-			return err
-		}
+		return openDBConnection(a.driverName, a.dataSourceName)
 	}
 
-	a.db = db.Scopes(a.casbinRuleTable()).Session(&gorm.Session{})
-	return a.createTable()
+	if err := a.createDatabase(); err != nil {
+		return nil, err
+	}
+	d, err := lookupDialect(a.driverName)
+	if err != nil {
+		return nil, err
+	}
+	dsn, err := d.DataSourceWithDatabase(a.dataSourceName, a.databaseName)
+	if err != nil {
+		return nil, err
+	}
+	return openDBConnection(a.driverName, dsn)
 }
 
 // AddLogger adds logger to db
@@ -401,24 +505,163 @@ func (a *Adapter) AddLogger(l logger.Interface) {
 	a.db = a.db.Session(&gorm.Session{Logger: l, Context: a.db.Statement.Context})
 }
 
+// EnableStrictMode makes the adapter reject rules that don't fit instead of truncating them.
+// A rule is rejected with a *RuleLengthError if it has more values than the table has value columns,
+// or than its policy_definition declares in the model last loaded or saved by the adapter.
+func (a *Adapter) EnableStrictMode(enable bool) {
+	a.strict = enable
+}
+
+// EnableExactMatch makes RemovePolicy, RemovePolicies, UpdatePolicy and UpdatePolicies
+// match the stored rules exactly, an empty value only matching an empty column.
+// By default, empty values match any value. RemoveFilteredPolicy always treats them as wildcards.
+func (a *Adapter) EnableExactMatch(enable bool) {
+	a.exactMatch = enable
+}
+
+// EnableNoOpErrors makes the writes that change nothing fail: adding rules that are all stored already
+// returns ErrPolicyExists, and removing or updating rules that match no stored rule returns ErrPolicyNotFound.
+// RemovePolicies and UpdatePolicies fail if one of the rules matches none, and change nothing.
+func (a *Adapter) EnableNoOpErrors(enable bool) {
+	a.noOpErrors = enable
+}
+
+// SetLoadBatchSize makes LoadPolicy read the table in batches of size rows, ordered by ID,
+// instead of reading all rows at once. This bounds the memory used when loading large tables.
+// A size of 0 disables batching.
+func (a *Adapter) SetLoadBatchSize(size int) {
+	a.loadBatchSize = size
+}
+
+// setDefinitions remembers the number of values each ptype of the model declares.
+func (a *Adapter) setDefinitions(m model.Model) {
+	defs := policyDefinitions(m)
+	a.definitions.Store(&defs)
+}
+
+func policyDefinitions(m model.Model) map[string]int {
+	defs := make(map[string]int)
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			defs[ptype] = len(ast.Tokens) + len(ast.ParamsTokens)
+		}
+	}
+	return defs
+}
+
+// checkRules returns a *RuleLengthError in strict mode if one of the rules doesn't fit.
+func (a *Adapter) checkRules(ptype string, rules ...[]string) error {
+	if !a.strict {
+		return nil
+	}
+
+	limit := a.getFieldCount()
+	if defs := a.definitions.Load(); defs != nil {
+		if n, ok := (*defs)[ptype]; ok && n < limit {
+			limit = n
+		}
+	}
+	for _, rule := range rules {
+		if len(rule) > limit {
+			return &RuleLengthError{Ptype: ptype, Rule: rule, Limit: limit}
+		}
+	}
+	return nil
+}
+
 func (a *Adapter) Close() error {
 	finalizer(a)
 	return nil
 }
 
-// getTableInstance return the dynamic table name
-func (a *Adapter) getTableInstance() *CasbinRule {
-	return &CasbinRule{}
+// getTableInstance return a new row of the dynamic table type
+func (a *Adapter) getTableInstance() interface{} {
+	return reflect.New(a.getTableType()).Interface()
+}
+
+// getFieldCount returns the number of value columns (v0, v1, ...) of the table.
+func (a *Adapter) getFieldCount() int {
+	if a.fieldCount > 0 {
+		return a.fieldCount
+	}
+	return defaultFieldCount
+}
+
+// getTableType returns the struct type used to read and write rows of the table.
+// It is CasbinRule for the default layout, the custom table type if one is given,
+// and a generated struct with fields Ptype, V0 ... V{n-1} of the column sizes otherwise,
+// with a DeletedAt field in soft delete mode.
+func (a *Adapter) getTableType() reflect.Type {
+	n := a.getFieldCount()
+	sizes := a.getColumnSizes()
+	if n == defaultFieldCount && !a.softDelete && sizes == defaultColumnSizes {
+		return casbinRuleType
+	}
+	if t := a.db.Statement.Context.Value(customTableKey); t != nil {
+		return reflect.Indirect(reflect.ValueOf(t)).Type()
+	}
+	return ruleTypeOf(n, a.softDelete, sizes)
 }
 
+// getFullTableName returns the name of the table with its prefix, qualified by the schema of the adapter if any.
 func (a *Adapter) getFullTableName() string {
+	tableName := a.tableName
 	if a.tablePrefix != "" {
 		if strings.HasSuffix(a.tablePrefix, "_") {
-			return a.tablePrefix + a.tableName
+			tableName = a.tablePrefix + a.tableName
+		} else {
+			tableName = a.tablePrefix + "_" + a.tableName
+		}
+	}
+	if a.schema != "" {
+		return a.schema + "." + tableName
+	}
+	return tableName
+}
+
+// identifierPattern matches a name the adapter puts in SQL, quoted:
+// letters, digits, underscores, dollar signs and dashes.
+var identifierPattern = regexp.MustCompile(`^[\p{L}\p{N}_$-]+$`)
+
+// checkIdentifier checks the name of a database, table or prefix before it is put in SQL.
+// A qualified name may have a schema, as in "authz.casbin_rule".
+func checkIdentifier(kind string, name string, qualified bool) error {
+	parts := []string{name}
+	if qualified {
+		parts = strings.Split(name, ".")
+		if len(parts) > 2 {
+			return errors.Errorf("invalid %s %q: only a schema may qualify it", kind, name)
+		}
+	}
+	for _, part := range parts {
+		if !identifierPattern.MatchString(part) {
+			return errors.Errorf("invalid %s %q: it may only contain letters, digits, \"_\", \"$\" and \"-\"", kind, name)
+		}
+	}
+	return nil
+}
+
+// checkNames checks the names of the database and table of the adapter.
+func (a *Adapter) checkNames() error {
+	if a.driverName != "" && !a.dbSpecified {
+		if err := checkIdentifier("database name", a.databaseName, false); err != nil {
+			return err
+		}
+	}
+	if a.tablePrefix != "" {
+		if err := checkIdentifier("table prefix", a.tablePrefix, false); err != nil {
+			return err
+		}
+	}
+	if a.schema != "" {
+		if err := checkIdentifier("schema", a.schema, false); err != nil {
+			return err
+		}
+		if strings.Contains(a.tableName, ".") {
+			return errors.Errorf("table name %q is qualified by a schema, but the schema %q is set", a.tableName, a.schema)
 		}
-		return a.tablePrefix + "_" + a.tableName
 	}
-	return a.tableName
+	return checkIdentifier("table name", a.tableName, true)
 }
 
 func (a *Adapter) casbinRuleTable() func(db *gorm.DB) *gorm.DB {
@@ -440,20 +683,59 @@ func (a *Adapter) createTable() error {
 		return a.db.AutoMigrate(t)
 	}
 
-	t = a.getTableInstance()
-	if err := a.db.AutoMigrate(t); err != nil {
+	if err := a.db.AutoMigrate(a.getTableInstance()); err != nil {
 		return err
 	}
+	return a.createUniqueIndex()
+}
 
-	tableName := a.getFullTableName()
-	index := strings.ReplaceAll("idx_"+tableName, ".", "_")
-	hasIndex := a.db.Migrator().HasIndex(t, index)
-	if !hasIndex {
-		if err := a.db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (ptype,v0,v1,v2,v3,v4,v5)", index, tableName)).Error; err != nil {
-			return err
-		}
+// createSchema creates the schema of the adapter if it is set and doesn't exist.
+// Schemas are supported on Postgres only.
+func (a *Adapter) createSchema() error {
+	if a.schema == "" {
+		return nil
 	}
-	return nil
+	if name := a.db.Dialector.Name(); name != "postgres" {
+		return errors.Errorf("schemas are only supported on postgres, not on %s", name)
+	}
+	if a.db.Statement.Context.Value(disableMigrateKey) != nil {
+		return nil
+	}
+	db := a.db.Session(&gorm.Session{NewDB: true})
+	return db.Exec("CREATE SCHEMA IF NOT EXISTS " + db.Statement.Quote(a.schema)).Error
+}
+
+// maxIndexNameLength is the length Postgres truncates identifiers to, the shortest of the supported databases.
+const maxIndexNameLength = 63
+
+// indexName returns the name of an index of the table, which may be qualified by a schema,
+// followed by suffix if not empty. The name includes the schema,
+// as index names may have to be unique in the database.
+// A name too long is shortened with a hash, so it is neither truncated by the database nor clashes with another.
+func indexName(table string, suffix string) string {
+	name := "idx_" + strings.ReplaceAll(table, ".", "_")
+	if suffix != "" {
+		name += "_" + suffix
+	}
+	if len(name) <= maxIndexNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte("idx_" + table + "_" + suffix))
+	n := maxIndexNameLength - 9
+	for !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n] + "_" + hex.EncodeToString(sum[:4])
+}
+
+// createIndex creates an index on a column of the table if it doesn't exist.
+func createIndex(db *gorm.DB, table string, column string) error {
+	index := indexName(table, column)
+	if db.Migrator().HasIndex(table, index) {
+		return nil
+	}
+	q := db.Statement.Quote
+	return db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", q(index), q(table), q(column))).Error
 }
 
 func (a *Adapter) dropTable() error {
@@ -465,36 +747,13 @@ func (a *Adapter) dropTable() error {
 	return a.db.Migrator().DropTable(t)
 }
 
-func (a *Adapter) truncateTable() error {
-	var sql string
-	switch a.db.Config.Name() {
-	case sqlite.DriverName:
-		sql = fmt.Sprintf("delete from %s", a.getFullTableName())
-	case "sqlite3":
-		sql = fmt.Sprintf("delete from %s", a.getFullTableName())
-	case "postgres":
-		sql = fmt.Sprintf("truncate table %s RESTART IDENTITY", a.getFullTableName())
-	case "sqlserver":
-		sql = fmt.Sprintf("truncate table %s", a.getFullTableName())
-	case "mysql":
-		sql = fmt.Sprintf("truncate table %s", a.getFullTableName())
-	default:
-		sql = fmt.Sprintf("truncate table %s", a.getFullTableName())
-	}
-	return a.db.Exec(sql).Error
+// truncateTable empties the table using db, which may be a transaction.
+func (a *Adapter) truncateTable(db *gorm.DB) error {
+	return dialectOf(db, a.driverName).TruncateTable(db, a.getFullTableName())
 }
 
 func loadPolicyLine(line CasbinRule, model model.Model) error {
-	var p = []string{line.Ptype,
-		line.V0, line.V1, line.V2,
-		line.V3, line.V4, line.V5}
-
-	index := len(p) - 1
-	for p[index] == "" {
-		index--
-	}
-	index += 1
-	p = p[:index]
+	p := line.policyArray()
 	err := persist.LoadPolicyArray(p, model)
 	if err != nil {
 		return err
@@ -509,10 +768,45 @@ func (a *Adapter) LoadPolicy(model model.Model) error {
 
 // LoadPolicyCtx loads policy from database.
 func (a *Adapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
-	var lines []CasbinRule
-	if err := a.db.WithContext(ctx).Order("ID").Find(&lines).Error; err != nil {
-		return err
+	a.setDefinitions(model)
+
+	return a.loadPolicyLines(a.db.WithContext(ctx), model)
+}
+
+// loadPolicyLines loads the rules matched by db into the model.
+// If a load batch size is set, the rules are read in batches by ID,
+// and each batch is previewed and loaded before the next one is read.
+func (a *Adapter) loadPolicyLines(db *gorm.DB, model model.Model) error {
+	if a.loadBatchSize <= 0 || layoutOf(a.getTableType()).id == nil {
+		lines, err := a.findRules(db.Order("ID"))
+		if err != nil {
+			return err
+		}
+		return a.loadLines(lines, model)
+	}
+
+	var lastID uint
+	for {
+		lines, err := a.findRules(db.Where("id > ?", lastID).Order("ID").Limit(a.loadBatchSize))
+		if err != nil {
+			return err
+		}
+		n := len(lines)
+		if n == 0 {
+			return nil
+		}
+		lastID = lines[n-1].ID
+
+		if err := a.loadLines(lines, model); err != nil {
+			return err
+		}
+		if n < a.loadBatchSize {
+			return nil
+		}
 	}
+}
+
+func (a *Adapter) loadLines(lines []CasbinRule, model model.Model) error {
 	err := a.Preview(&lines, model)
 	if err != nil {
 		return err
@@ -523,17 +817,42 @@ func (a *Adapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
 			return err
 		}
 	}
-
 	return nil
 }
 
 // LoadFilteredPolicy loads only policy rules that match the filter.
 func (a *Adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
-	var lines []CasbinRule
+	return a.LoadFilteredPolicyCtx(context.Background(), model, filter)
+}
+
+// LoadFilteredPolicyCtx loads only policy rules that match the filter.
+func (a *Adapter) LoadFilteredPolicyCtx(ctx context.Context, model model.Model, filter interface{}) error {
+	queryStr, queryArgs, err := filterCondition(filter)
+	if err != nil {
+		return err
+	}
+	a.setDefinitions(model)
+
+	// The filters are OR'ed into a single query, so a rule matched by
+	// several filters is only loaded once.
+	if queryStr != "" {
+		db := a.db.WithContext(ctx).Where(queryStr, queryArgs...)
+		if err := a.loadPolicyLines(db, model); err != nil {
+			return err
+		}
+	}
+	a.isFiltered = true
+
+	return nil
+}
 
+// filterCondition returns the condition matching the rules matched by any of the filters of filter,
+// or an empty condition if it holds no filter.
+func filterCondition(filter interface{}) (string, []interface{}, error) {
 	batchFilter := BatchFilter{
 		filters: []Filter{},
 	}
+	var predicateFilters []PredicateFilter
 	switch filterValue := filter.(type) {
 	case Filter:
 		batchFilter.filters = []Filter{filterValue}
@@ -545,25 +864,32 @@ func (a *Adapter) LoadFilteredPolicy(model model.Model, filter interface{}) erro
 		batchFilter = filterValue
 	case *BatchFilter:
 		batchFilter = *filterValue
+	case PredicateFilter:
+		predicateFilters = []PredicateFilter{filterValue}
+	case *PredicateFilter:
+		predicateFilters = []PredicateFilter{*filterValue}
+	case []PredicateFilter:
+		predicateFilters = filterValue
 	default:
-		return errors.New("unsupported filter type")
+		return "", nil, errors.New("unsupported filter type")
 	}
 
+	var queryStrs []string
+	var queryArgs []interface{}
 	for _, f := range batchFilter.filters {
-		if err := a.db.Scopes(a.filterQuery(a.db, f)).Order("ID").Find(&lines).Error; err != nil {
-			return err
-		}
-
-		for _, line := range lines {
-			err := loadPolicyLine(line, model)
-			if err != nil {
-				return err
-			}
+		str, args := filterWhere(f)
+		queryStrs = append(queryStrs, "("+str+")")
+		queryArgs = append(queryArgs, args...)
+	}
+	for _, f := range predicateFilters {
+		str, args, err := predicateFilterWhere(f)
+		if err != nil {
+			return "", nil, err
 		}
+		queryStrs = append(queryStrs, "("+str+")")
+		queryArgs = append(queryArgs, args...)
 	}
-	a.isFiltered = true
-
-	return nil
+	return strings.Join(queryStrs, " or "), queryArgs, nil
 }
 
 // IsFiltered returns true if the loaded policy has been filtered.
@@ -571,58 +897,167 @@ func (a *Adapter) IsFiltered() bool {
 	return a.isFiltered
 }
 
-// filterQuery builds the gorm query to match the rule filter to use within a scope.
-func (a *Adapter) filterQuery(db *gorm.DB, filter Filter) func(db *gorm.DB) *gorm.DB {
-	return func(db *gorm.DB) *gorm.DB {
-		if len(filter.Ptype) > 0 {
-			db = db.Where("ptype in (?)", filter.Ptype)
+// IsFilteredCtx returns true if the loaded policy has been filtered.
+func (a *Adapter) IsFilteredCtx(ctx context.Context) bool {
+	return a.isFiltered
+}
+
+// filterWhere builds the where condition matching the rule filter.
+func filterWhere(filter Filter) (string, []interface{}) {
+	return filterWhereOn(filter, valueColumn)
+}
+
+// valueColumn returns the column of the value at index i of a rule.
+func valueColumn(i int) string {
+	return fmt.Sprintf("v%d", i)
+}
+
+// filterWhereOn returns the condition matching the filter, value(i) being the SQL expression
+// of the value at index i of a rule.
+func filterWhereOn(filter Filter, value func(i int) string) (string, []interface{}) {
+	var queryStrs []string
+	var queryArgs []interface{}
+	if len(filter.Ptype) > 0 {
+		queryStrs = append(queryStrs, "ptype in (?)")
+		queryArgs = append(queryArgs, filter.Ptype)
+	}
+	for i, v := range filter.values() {
+		if len(v) > 0 {
+			queryStrs = append(queryStrs, fmt.Sprintf("%s in (?)", value(i)))
+			queryArgs = append(queryArgs, v)
+		}
+	}
+	if len(queryStrs) == 0 {
+		return "1 = 1", nil
+	}
+	return strings.Join(queryStrs, " and "), queryArgs
+}
+
+// predicateFilterWhere builds the where condition matching the predicate filter.
+func predicateFilterWhere(filter PredicateFilter) (string, []interface{}, error) {
+	columns := append([][]Predicate{filter.Ptype, filter.V0, filter.V1, filter.V2, filter.V3, filter.V4, filter.V5}, filter.ExtraV...)
+
+	var queryStrs []string
+	var queryArgs []interface{}
+	for i, predicates := range columns {
+		column := "ptype"
+		if i > 0 {
+			column = fmt.Sprintf("v%d", i-1)
+		}
+		for _, p := range predicates {
+			str, args, err := predicateWhere(column, p)
+			if err != nil {
+				return "", nil, err
+			}
+			queryStrs = append(queryStrs, "("+str+")")
+			queryArgs = append(queryArgs, args...)
+		}
+	}
+	if len(queryStrs) == 0 {
+		return "1 = 1", nil, nil
+	}
+	return strings.Join(queryStrs, " and "), queryArgs, nil
+}
+
+// predicateWhere builds the parameterized where condition of a predicate on column.
+func predicateWhere(column string, p Predicate) (string, []interface{}, error) {
+	switch p.Type {
+	case PredicateTypeEqual, PredicateTypePrefix, PredicateTypeLike:
+		if len(p.Values) != 1 {
+			return "", nil, errors.Errorf("predicate on %s needs exactly one value, got %d", column, len(p.Values))
 		}
-		if len(filter.V0) > 0 {
-			db = db.Where("v0 in (?)", filter.V0)
+	case PredicateTypeIn:
+		if len(p.Values) == 0 {
+			return "", nil, errors.Errorf("IN predicate on %s needs at least one value", column)
 		}
-		if len(filter.V1) > 0 {
-			db = db.Where("v1 in (?)", filter.V1)
+	case PredicateTypeRange:
+		if len(p.Values) != 2 {
+			return "", nil, errors.Errorf("range predicate on %s needs two bounds, got %d", column, len(p.Values))
 		}
-		if len(filter.V2) > 0 {
-			db = db.Where("v2 in (?)", filter.V2)
+	}
+
+	switch p.Type {
+	case PredicateTypeEqual:
+		return column + " = ?", []interface{}{p.Values[0]}, nil
+	case PredicateTypeIn:
+		return column + " in (?)", []interface{}{p.Values}, nil
+	case PredicateTypeNotIn:
+		if len(p.Values) == 0 {
+			return "1 = 1", nil, nil
 		}
-		if len(filter.V3) > 0 {
-			db = db.Where("v3 in (?)", filter.V3)
+		return column + " not in (?)", []interface{}{p.Values}, nil
+	case PredicateTypePrefix:
+		return column + " like ? escape '!'", []interface{}{escapeLike(p.Values[0]) + "%"}, nil
+	case PredicateTypeLike:
+		return column + " like ?", []interface{}{p.Values[0]}, nil
+	case PredicateTypeEmpty:
+		return fmt.Sprintf("(%s = '' or %s is null)", column, column), nil, nil
+	case PredicateTypeRange:
+		var queries []string
+		var args []interface{}
+		if p.Values[0] != "" {
+			queries = append(queries, column+" >= ?")
+			args = append(args, p.Values[0])
 		}
-		if len(filter.V4) > 0 {
-			db = db.Where("v4 in (?)", filter.V4)
+		if p.Values[1] != "" {
+			queries = append(queries, column+" < ?")
+			args = append(args, p.Values[1])
 		}
-		if len(filter.V5) > 0 {
-			db = db.Where("v5 in (?)", filter.V5)
+		if len(queries) == 0 {
+			return "1 = 1", nil, nil
 		}
-		return db
+		return strings.Join(queries, " and "), args, nil
+	default:
+		return "", nil, errors.Errorf("unsupported predicate type %d on %s", p.Type, column)
 	}
 }
 
-func (a *Adapter) savePolicyLine(ptype string, rule []string) CasbinRule {
-	line := a.getTableInstance()
+// escapeLike escapes the LIKE wildcards in s, with '!' as the escape character.
+// '[' is escaped too, as SQL Server treats it as a wildcard.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "[", "![").Replace(s)
+}
 
-	line.Ptype = ptype
-	if len(rule) > 0 {
-		line.V0 = rule[0]
+func (a *Adapter) savePolicyLine(ptype string, rule []string) CasbinRule {
+	line := CasbinRule{Ptype: ptype}
+	if n := a.getFieldCount(); len(rule) > n {
+		rule = rule[:n]
 	}
-	if len(rule) > 1 {
-		line.V1 = rule[1]
+	line.setValues(rule)
+
+	return line
+}
+
+// filteredPolicyLine builds a rule whose values from fieldIndex on are fieldValues.
+func (a *Adapter) filteredPolicyLine(ptype string, fieldIndex int, fieldValues ...string) CasbinRule {
+	values := make([]string, a.getFieldCount())
+	for i := range values {
+		if fieldIndex <= i && i < fieldIndex+len(fieldValues) {
+			values[i] = fieldValues[i-fieldIndex]
+		}
 	}
-	if len(rule) > 2 {
-		line.V2 = rule[2]
+
+	line := CasbinRule{Ptype: ptype}
+	line.setValues(values)
+	return line
+}
+
+// filteredRuleLine checks the field index and values of a filtered removal or update,
+// and returns the rule matching the rows. A field index of -1 matches all the rules of ptype.
+func (a *Adapter) filteredRuleLine(ptype string, fieldIndex int, fieldValues []string) (CasbinRule, error) {
+	if fieldIndex == -1 {
+		return CasbinRule{Ptype: ptype}, nil
 	}
-	if len(rule) > 3 {
-		line.V3 = rule[3]
+	if fieldIndex < 0 {
+		return CasbinRule{}, errors.Errorf("invalid field index %d", fieldIndex)
 	}
-	if len(rule) > 4 {
-		line.V4 = rule[4]
+	if err := checkQueryField(fieldValues); err != nil {
+		return CasbinRule{}, err
 	}
-	if len(rule) > 5 {
-		line.V5 = rule[5]
+	if n := a.getFieldCount(); fieldIndex+len(fieldValues) > n {
+		return CasbinRule{}, errors.Errorf("field index %d with %d values exceeds the %d value columns of the table", fieldIndex, len(fieldValues), n)
 	}
-
-	return *line
+	return a.filteredPolicyLine(ptype, fieldIndex, fieldValues...), nil
 }
 
 // SavePolicy saves policy to database.
@@ -632,52 +1067,198 @@ func (a *Adapter) SavePolicy(model model.Model) error {
 
 // SavePolicyCtx saves policy to database.
 func (a *Adapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
-	var err error
-	tx := a.db.WithContext(ctx).Clauses(dbresolver.Write).Begin()
-
-	err = a.truncateTable()
-
-	if err != nil {
-		tx.Rollback()
+	if a.softDelete {
+		// Emptying the table would delete the rows for good.
+		_, _, err := a.SavePolicyDiffCtx(ctx, model)
 		return err
 	}
-
-	var lines []CasbinRule
-	flushEvery := 1000
-	for ptype, ast := range model["p"] {
-		for _, rule := range ast.Policy {
-			lines = append(lines, a.savePolicyLine(ptype, rule))
-			if len(lines) > flushEvery {
-				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lines).Error; err != nil {
-					tx.Rollback()
-					return err
-				}
-				lines = nil
-			}
-		}
+	if err := a.checkModel(model); err != nil {
+		return err
 	}
 
-	for ptype, ast := range model["g"] {
-		for _, rule := range ast.Policy {
-			lines = append(lines, a.savePolicyLine(ptype, rule))
-			if len(lines) > flushEvery {
-				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lines).Error; err != nil {
-					tx.Rollback()
-					return err
-				}
-				lines = nil
+	return a.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		// The audit trail and dry runs record the rules removed and added by the save.
+		recordRules := a.auditTable != "" || a.dryRun != nil
+		var stored []CasbinRule
+		if recordRules {
+			var err error
+			if stored, err = a.findRules(tx.Order("ID")); err != nil {
+				return err
 			}
 		}
-	}
-	if len(lines) > 0 {
-		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lines).Error; err != nil {
-			tx.Rollback()
+
+		if err := a.truncateTable(tx); err != nil {
 			return err
 		}
+
+		var lines, saved []CasbinRule
+		flushEvery := 1000
+		for _, sec := range []string{"p", "g"} {
+			for ptype, ast := range model[sec] {
+				for _, rule := range ast.Policy {
+					lines = append(lines, a.savePolicyLine(ptype, rule))
+					if recordRules {
+						saved = append(saved, lines[len(lines)-1])
+					}
+					if len(lines) > flushEvery {
+						if err := tx.Clauses(dialectOf(tx, a.driverName).IgnoreConflict()).Create(a.toRows(lines)).Error; err != nil {
+							return err
+						}
+						lines = nil
+					}
+				}
+			}
+		}
+		if len(lines) > 0 {
+			if err := tx.Clauses(dialectOf(tx, a.driverName).IgnoreConflict()).Create(a.toRows(lines)).Error; err != nil {
+				return err
+			}
+		}
+
+		removed, added := diffRules(stored, saved)
+		return a.recordChange(tx, ChangeOpSave, removed, added)
+	})
+}
+
+// checkModel remembers the policy definitions of the model and checks its rules in strict mode.
+func (a *Adapter) checkModel(model model.Model) error {
+	a.setDefinitions(model)
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			if err := a.checkRules(ptype, ast.Policy...); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	err = tx.Commit().Error
-	return err
+// SavePolicyDiff saves policy to database by writing only the differences.
+func (a *Adapter) SavePolicyDiff(model model.Model) (added int, removed int, err error) {
+	return a.SavePolicyDiffCtx(context.Background(), model)
+}
+
+// SavePolicyDiffCtx saves policy to database by writing only the differences.
+// Unlike SavePolicyCtx, it doesn't rewrite the table: it reads the stored rules,
+// deletes the ones no longer in the model and inserts the missing ones, in one transaction.
+// It returns the number of rules added and removed.
+func (a *Adapter) SavePolicyDiffCtx(ctx context.Context, model model.Model) (added int, removed int, err error) {
+	if err := a.checkModel(model); err != nil {
+		return 0, 0, err
+	}
+
+	lines := a.modelLines(model)
+	err = a.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		added, removed, err = a.replaceRules(tx, ChangeOpSaveDiff, lines)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, removed, nil
+}
+
+// modelLines returns the rules of the model as rows of the table.
+func (a *Adapter) modelLines(model model.Model) []CasbinRule {
+	var lines []CasbinRule
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				lines = append(lines, a.savePolicyLine(ptype, rule))
+			}
+		}
+	}
+	return lines
+}
+
+// replaceRules makes the rules of the table the given ones within tx, by deleting the stored rules
+// not among them and inserting the missing ones, and records the change.
+// It returns the number of rules added and removed.
+func (a *Adapter) replaceRules(tx *gorm.DB, op ChangeOp, lines []CasbinRule) (added int, removed int, err error) {
+	stored, err := a.findRules(tx.Order("ID"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wanted := make(map[string]bool)
+	var unique []CasbinRule
+	for _, line := range lines {
+		key := policyKey(line.policyArray())
+		if _, ok := wanted[key]; !ok {
+			wanted[key] = false
+			unique = append(unique, line)
+		}
+	}
+
+	// Keep the first stored row of each wanted rule and delete everything else.
+	var ids []uint
+	var deleted []CasbinRule
+	for _, line := range stored {
+		key := policyKey(line.policyArray())
+		if found, ok := wanted[key]; ok && !found {
+			wanted[key] = true
+			continue
+		}
+		ids = append(ids, line.ID)
+		deleted = append(deleted, line)
+	}
+
+	var missing []CasbinRule
+	for _, line := range unique {
+		if !wanted[policyKey(line.policyArray())] {
+			missing = append(missing, line)
+		}
+	}
+
+	flushEvery := 1000
+	for i := 0; i < len(ids); i += flushEvery {
+		end := min(i+flushEvery, len(ids))
+		if err := tx.Where("id IN ?", ids[i:end]).Delete(a.getTableInstance()).Error; err != nil {
+			return 0, 0, err
+		}
+	}
+	var inserted []CasbinRule
+	for i := 0; i < len(missing); i += flushEvery {
+		end := min(i+flushEvery, len(missing))
+		rules, n, err := a.insertRules(tx, missing[i:end])
+		if err != nil {
+			return 0, 0, err
+		}
+		inserted = append(inserted, rules...)
+		added += int(n)
+	}
+
+	if err := a.recordChange(tx, op, deleted, inserted); err != nil {
+		return 0, 0, err
+	}
+	return added, len(ids), nil
+}
+
+// diffRules returns the rules of from missing in to, and the rules of to missing in from.
+func diffRules(from []CasbinRule, to []CasbinRule) (removed []CasbinRule, added []CasbinRule) {
+	fromKeys := make(map[string]bool, len(from))
+	for _, line := range from {
+		fromKeys[policyKey(line.policyArray())] = true
+	}
+	toKeys := make(map[string]bool, len(to))
+	for _, line := range to {
+		key := policyKey(line.policyArray())
+		if !toKeys[key] && !fromKeys[key] {
+			added = append(added, line)
+		}
+		toKeys[key] = true
+	}
+	for _, line := range from {
+		if !toKeys[policyKey(line.policyArray())] {
+			removed = append(removed, line)
+		}
+	}
+	return removed, added
+}
+
+// policyKey returns a key identifying a rule given as ptype followed by its values.
+func policyKey(p []string) string {
+	return strings.Join(p, "\x00")
 }
 
 // AddPolicy adds a policy rule to the storage.
@@ -687,11 +1268,111 @@ func (a *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
 
 // AddPolicyCtx adds a policy rule to the storage.
 func (a *Adapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
-	line := a.savePolicyLine(ptype, rule)
-	err := a.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&line).Error
+	_, err := a.AddPoliciesAffected(ctx, sec, ptype, [][]string{rule})
 	return err
 }
 
+// errRulesStored is returned by the insert of rules some of which were stored concurrently.
+var errRulesStored = errors.New("some of the rules were stored concurrently")
+
+// insertRules inserts the rules missing from the table within tx.
+// In soft delete mode, the deleted rows equal to the rules are restored instead.
+// It returns the number of rules inserted or restored.
+// If changes are tracked, it returns these rules too, the ones already stored being skipped.
+// The rules a concurrent writer stored after they were read are skipped by the insert,
+// which is then rolled back and done rule by rule to return only the rules inserted.
+func (a *Adapter) insertRules(tx *gorm.DB, lines []CasbinRule) ([]CasbinRule, int64, error) {
+	if !a.tracksChanges() {
+		n, err := a.storeRules(tx, lines)
+		if err != nil {
+			return nil, 0, err
+		}
+		return lines, n, nil
+	}
+
+	lines, err := a.missingRules(tx, lines)
+	if err != nil || len(lines) == 0 {
+		return nil, 0, err
+	}
+	var n int64
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if n, err = a.storeRules(tx, lines); err == nil && n != int64(len(lines)) {
+			err = errRulesStored
+		}
+		return err
+	})
+	if err == nil {
+		return lines, n, nil
+	}
+	if !errors.Is(err, errRulesStored) {
+		return nil, 0, err
+	}
+
+	var inserted []CasbinRule
+	n = 0
+	for i := range lines {
+		stored, err := a.storeRules(tx, lines[i:i+1])
+		if err != nil {
+			return nil, 0, err
+		}
+		if stored > 0 {
+			inserted = append(inserted, lines[i])
+			n += stored
+		}
+	}
+	return inserted, n, nil
+}
+
+// storeRules inserts the rules within tx, skipping the ones already stored,
+// and restores the deleted rows equal to them in soft delete mode.
+// It returns the number of rows inserted or restored.
+func (a *Adapter) storeRules(tx *gorm.DB, lines []CasbinRule) (int64, error) {
+	var n int64
+	if a.softDelete {
+		chunkSize := 100
+		for i := 0; i < len(lines); i += chunkSize {
+			queryStr, queryArgs := whereAny(lines[i:min(i+chunkSize, len(lines))], a.exactWhere)
+			result := tx.Unscoped().Model(a.getTableInstance()).Where("deleted_at is not null").Where(queryStr, queryArgs...).Update("deleted_at", nil)
+			if result.Error != nil {
+				return 0, result.Error
+			}
+			n += result.RowsAffected
+		}
+	}
+	result := tx.Clauses(dialectOf(tx, a.driverName).IgnoreConflict()).Create(a.toRows(lines))
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return n + result.RowsAffected, nil
+}
+
+// missingRules returns the rules not stored in the table, each once.
+func (a *Adapter) missingRules(tx *gorm.DB, lines []CasbinRule) ([]CasbinRule, error) {
+	found := make(map[string]bool, len(lines))
+	chunkSize := 100
+	for i := 0; i < len(lines); i += chunkSize {
+		queryStr, queryArgs := whereAny(lines[i:min(i+chunkSize, len(lines))], a.exactWhere)
+		stored, err := a.findRules(tx.Where(queryStr, queryArgs...))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range stored {
+			found[policyKey(line.policyArray())] = true
+		}
+	}
+
+	var missing []CasbinRule
+	for _, line := range lines {
+		key := policyKey(line.policyArray())
+		if !found[key] {
+			found[key] = true
+			missing = append(missing, line)
+		}
+	}
+	return missing, nil
+}
+
 // RemovePolicy removes a policy rule from the storage.
 func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
 	return a.RemovePolicyCtx(context.Background(), sec, ptype, rule)
@@ -700,28 +1381,72 @@ func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
 // RemovePolicyCtx removes a policy rule from the storage.
 func (a *Adapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
 	line := a.savePolicyLine(ptype, rule)
-	err := a.rawDelete(ctx, a.db, line) //can't use db.Delete as we're not using primary key https://gorm.io/docs/update.html
-	return err
+	queryStr, queryArgs := a.ruleWhere(line)
+	return a.writeTx(ctx, func(tx *gorm.DB) error {
+		n, err := a.deleteRules(tx, ChangeOpRemove, queryStr, queryArgs...)
+		if err == nil && n == 0 && a.noOpErrors {
+			return ErrPolicyNotFound
+		}
+		return err
+	})
+}
+
+// deleteRules deletes the rows matching the condition within tx, records the change,
+// and returns the number of rows deleted.
+func (a *Adapter) deleteRules(tx *gorm.DB, op ChangeOp, queryStr interface{}, queryArgs ...interface{}) (int64, error) {
+	var removed []CasbinRule
+	if a.tracksChanges() {
+		var err error
+		if removed, err = a.findRules(tx.Where(queryStr, queryArgs...)); err != nil {
+			return 0, err
+		}
+	}
+	//can't use db.Delete as we're not using primary key https://gorm.io/docs/update.html
+	result := tx.Where(queryStr, queryArgs...).Delete(a.getTableInstance())
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return result.RowsAffected, a.recordChange(tx, op, removed, nil)
 }
 
 // AddPolicies adds multiple policy rules to the storage.
 func (a *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
-	var lines []CasbinRule
-	for _, rule := range rules {
-		line := a.savePolicyLine(ptype, rule)
-		lines = append(lines, line)
-	}
-	return a.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&lines).Error
+	return a.AddPoliciesCtx(context.Background(), sec, ptype, rules)
 }
 
 // AddPoliciesCtx adds multiple policy rules to the storage.
 func (a *Adapter) AddPoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	_, err := a.AddPoliciesAffected(ctx, sec, ptype, rules)
+	return err
+}
+
+// AddPoliciesAffected adds multiple policy rules to the storage,
+// and returns the number of rules inserted, the ones already stored being skipped.
+func (a *Adapter) AddPoliciesAffected(ctx context.Context, sec string, ptype string, rules [][]string) (int64, error) {
+	if err := a.checkRules(ptype, rules...); err != nil {
+		return 0, err
+	}
 	var lines []CasbinRule
 	for _, rule := range rules {
 		line := a.savePolicyLine(ptype, rule)
 		lines = append(lines, line)
 	}
-	return a.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&lines).Error
+	var n int64
+	err := a.writeTx(ctx, func(tx *gorm.DB) error {
+		added, inserted, err := a.insertRules(tx, lines)
+		if err != nil {
+			return err
+		}
+		if inserted == 0 && a.noOpErrors {
+			return ErrPolicyExists
+		}
+		n = inserted
+		return a.recordChange(tx, ChangeOpAdd, nil, added)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
 // Transaction perform a set of operations within a transaction.
@@ -780,10 +1505,11 @@ func (a *Adapter) Transaction(e casbin.IEnforcer, fc func(casbin.IEnforcer) erro
 	// use GORM transaction functionality
 	err := adapter.db.Transaction(func(tx *gorm.DB) error {
 		// create transaction adapter
-		txAdapter, err := NewAdapterByDB(tx)
+		txAdapter, err := newAdapterByDB(tx, adapter.schema, adapter.tablePrefix, adapter.tableName, adapter.fieldCount, adapter.columnSizes)
 		if err != nil {
 			return errors.Wrap(err, "failed to initialize gorm adapter")
 		}
+		txAdapter.copySettings(adapter)
 
 		// temporarily set transaction adapter
 		e.SetAdapter(txAdapter)
@@ -871,17 +1597,22 @@ func (gtx *GormTransactionContext) Rollback() error {
 // GetAdapter returns an adapter that operates within this transaction.
 // All policy operations through this adapter will be part of the transaction.
 func (gtx *GormTransactionContext) GetAdapter() persist.Adapter {
-	return &Adapter{
+	adapter := &Adapter{
 		driverName:     gtx.adapter.driverName,
 		dataSourceName: gtx.adapter.dataSourceName,
 		databaseName:   gtx.adapter.databaseName,
+		schema:         gtx.adapter.schema,
 		tablePrefix:    gtx.adapter.tablePrefix,
 		tableName:      gtx.tableName,
 		dbSpecified:    gtx.adapter.dbSpecified,
 		db:             gtx.tx, // Use transaction connection
 		isFiltered:     gtx.adapter.isFiltered,
+		fieldCount:     gtx.adapter.fieldCount,
+		columnSizes:    gtx.adapter.columnSizes,
 		// Note: No transactionMu needed as each transaction has its own adapter
 	}
+	adapter.copySettings(gtx.adapter)
+	return adapter
 }
 
 // RemovePolicies removes multiple policy rules from the storage.
@@ -891,14 +1622,77 @@ func (a *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) err
 
 // RemovePoliciesCtx removes multiple policy rules from the storage.
 func (a *Adapter) RemovePoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
-	return a.db.Transaction(func(tx *gorm.DB) error {
-		for _, rule := range rules {
-			line := a.savePolicyLine(ptype, rule)
-			if err := a.rawDelete(ctx, tx, line); err != nil { //can't use db.Delete as we're not using primary key https://gorm.io/docs/update.html
+	_, err := a.RemovePoliciesAffected(ctx, sec, ptype, rules)
+	return err
+}
+
+// RemovePoliciesAffected removes multiple policy rules from the storage,
+// and returns the number of rows deleted.
+func (a *Adapter) RemovePoliciesAffected(ctx context.Context, sec string, ptype string, rules [][]string) (int64, error) {
+	_, n, err := a.removePolicies(ctx, ptype, rules, a.noOpErrors, a.noOpErrors)
+	return n, err
+}
+
+// RemovePoliciesReportMissing removes multiple policy rules from the storage,
+// and returns the rules that were not found in it.
+func (a *Adapter) RemovePoliciesReportMissing(sec string, ptype string, rules [][]string) ([][]string, error) {
+	return a.RemovePoliciesReportMissingCtx(context.Background(), sec, ptype, rules)
+}
+
+// RemovePoliciesReportMissingCtx removes multiple policy rules from the storage,
+// and returns the rules that were not found in it.
+func (a *Adapter) RemovePoliciesReportMissingCtx(ctx context.Context, sec string, ptype string, rules [][]string) ([][]string, error) {
+	missing, _, err := a.removePolicies(ctx, ptype, rules, true, false)
+	return missing, err
+}
+
+// removePolicies deletes the rules in one transaction, with one statement per chunk of rules,
+// and returns the number of rows deleted.
+// If findMissing is true, the matching rows are read first to return the rules matching none,
+// or to fail with ErrPolicyNotFound if failOnMissing is true.
+func (a *Adapter) removePolicies(ctx context.Context, ptype string, rules [][]string, findMissing bool, failOnMissing bool) ([][]string, int64, error) {
+	var missing [][]string
+	var removed []CasbinRule
+	var n int64
+	err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		chunkSize := 100
+		for i := 0; i < len(rules); i += chunkSize {
+			chunk := rules[i:min(i+chunkSize, len(rules))]
+			lines := make([]CasbinRule, 0, len(chunk))
+			for _, rule := range chunk {
+				lines = append(lines, a.savePolicyLine(ptype, rule))
+			}
+			queryStr, queryArgs := a.ruleWhereAny(lines)
+
+			if findMissing || a.tracksChanges() {
+				stored, err := a.findRules(tx.Where(queryStr, queryArgs...))
+				if err != nil {
+					return err
+				}
+				for j, line := range lines {
+					if findMissing && !line.matchesAny(stored, a.exactMatch) {
+						missing = append(missing, chunk[j])
+					}
+				}
+				removed = append(removed, stored...)
+			}
+
+			//can't use db.Delete as we're not using primary key https://gorm.io/docs/update.html
+			result := tx.Where(queryStr, queryArgs...).Delete(a.getTableInstance())
+			if result.Error != nil {
+				return result.Error
 			}
+			n += result.RowsAffected
 		}
-		return nil
+		if len(missing) > 0 && failOnMissing {
+			return ErrPolicyNotFound
+		}
+		return a.recordChange(tx, ChangeOpRemove, removed, nil)
 	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return missing, n, nil
 }
 
 // RemoveFilteredPolicy removes policy rules that match the filter from the storage.
@@ -908,39 +1702,32 @@ func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int,
 
 // RemoveFilteredPolicyCtx removes policy rules that match the filter from the storage.
 func (a *Adapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) error {
-	line := a.getTableInstance()
-
-	line.Ptype = ptype
-
-	if fieldIndex == -1 {
-		return a.rawDelete(ctx, a.db, *line)
-	}
+	_, err := a.RemoveFilteredPolicyAffected(ctx, sec, ptype, fieldIndex, fieldValues...)
+	return err
+}
 
-	err := checkQueryField(fieldValues)
+// RemoveFilteredPolicyAffected removes policy rules that match the filter from the storage,
+// and returns the number of rows deleted.
+func (a *Adapter) RemoveFilteredPolicyAffected(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) (int64, error) {
+	line, err := a.filteredRuleLine(ptype, fieldIndex, fieldValues)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
-		line.V0 = fieldValues[0-fieldIndex]
-	}
-	if fieldIndex <= 1 && 1 < fieldIndex+len(fieldValues) {
-		line.V1 = fieldValues[1-fieldIndex]
-	}
-	if fieldIndex <= 2 && 2 < fieldIndex+len(fieldValues) {
-		line.V2 = fieldValues[2-fieldIndex]
-	}
-	if fieldIndex <= 3 && 3 < fieldIndex+len(fieldValues) {
-		line.V3 = fieldValues[3-fieldIndex]
-	}
-	if fieldIndex <= 4 && 4 < fieldIndex+len(fieldValues) {
-		line.V4 = fieldValues[4-fieldIndex]
-	}
-	if fieldIndex <= 5 && 5 < fieldIndex+len(fieldValues) {
-		line.V5 = fieldValues[5-fieldIndex]
+	queryStr, queryArgs := appendWhere(line)
+	var n int64
+	err = a.writeTx(ctx, func(tx *gorm.DB) error {
+		var err error
+		n, err = a.deleteRules(tx, ChangeOpRemoveFiltered, queryStr, queryArgs...)
+		if err == nil && n == 0 && a.noOpErrors {
+			return ErrPolicyNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	err = a.rawDelete(ctx, a.db, *line)
-	return err
+	return n, nil
 }
 
 // checkQueryfield make sure the fields won't all be empty (string --> "")
@@ -953,78 +1740,136 @@ func checkQueryField(fieldValues []string) error {
 	return errors.New("the query field cannot all be empty string (\"\"), please check")
 }
 
-func (a *Adapter) rawDelete(ctx context.Context, db *gorm.DB, line CasbinRule) error {
+func appendWhere(line CasbinRule) (string, []interface{}) {
 	queryArgs := []interface{}{line.Ptype}
 
 	queryStr := "ptype = ?"
-	if line.V0 != "" {
-		queryStr += " and v0 = ?"
-		queryArgs = append(queryArgs, line.V0)
-	}
-	if line.V1 != "" {
-		queryStr += " and v1 = ?"
-		queryArgs = append(queryArgs, line.V1)
-	}
-	if line.V2 != "" {
-		queryStr += " and v2 = ?"
-		queryArgs = append(queryArgs, line.V2)
-	}
-	if line.V3 != "" {
-		queryStr += " and v3 = ?"
-		queryArgs = append(queryArgs, line.V3)
-	}
-	if line.V4 != "" {
-		queryStr += " and v4 = ?"
-		queryArgs = append(queryArgs, line.V4)
+	for i, v := range line.values() {
+		if v != "" {
+			queryStr += fmt.Sprintf(" and v%d = ?", i)
+			queryArgs = append(queryArgs, v)
+		}
 	}
-	if line.V5 != "" {
-		queryStr += " and v5 = ?"
-		queryArgs = append(queryArgs, line.V5)
+	return queryStr, queryArgs
+}
+
+// ruleWhere returns the condition matching the stored rows of a rule:
+// in exact match mode every value must be equal, otherwise only the non-empty ones.
+func (a *Adapter) ruleWhere(line CasbinRule) (string, []interface{}) {
+	if !a.exactMatch {
+		return appendWhere(line)
 	}
-	args := append([]interface{}{queryStr}, queryArgs...)
-	err := db.WithContext(ctx).Delete(a.getTableInstance(), args...).Error
-	return err
+	return a.exactWhere(line)
 }
 
-func appendWhere(line CasbinRule) (string, []interface{}) {
+// exactWhere returns the condition matching the rows equal to the rule, empty values included.
+func (a *Adapter) exactWhere(line CasbinRule) (string, []interface{}) {
 	queryArgs := []interface{}{line.Ptype}
-
 	queryStr := "ptype = ?"
-	if line.V0 != "" {
-		queryStr += " and v0 = ?"
-		queryArgs = append(queryArgs, line.V0)
-	}
-	if line.V1 != "" {
-		queryStr += " and v1 = ?"
-		queryArgs = append(queryArgs, line.V1)
-	}
-	if line.V2 != "" {
-		queryStr += " and v2 = ?"
-		queryArgs = append(queryArgs, line.V2)
-	}
-	if line.V3 != "" {
-		queryStr += " and v3 = ?"
-		queryArgs = append(queryArgs, line.V3)
-	}
-	if line.V4 != "" {
-		queryStr += " and v4 = ?"
-		queryArgs = append(queryArgs, line.V4)
-	}
-	if line.V5 != "" {
-		queryStr += " and v5 = ?"
-		queryArgs = append(queryArgs, line.V5)
+	values := line.values()
+	for i := 0; i < a.getFieldCount(); i++ {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		queryStr += fmt.Sprintf(" and v%d = ?", i)
+		queryArgs = append(queryArgs, v)
 	}
 	return queryStr, queryArgs
 }
 
+// ruleWhereAny returns a condition matching the rows matched by any of the lines.
+func (a *Adapter) ruleWhereAny(lines []CasbinRule) (string, []interface{}) {
+	return whereAny(lines, a.ruleWhere)
+}
+
+// whereAny returns the condition matching the rows matched by the condition of any of the lines.
+func whereAny(lines []CasbinRule, where func(CasbinRule) (string, []interface{})) (string, []interface{}) {
+	var queryStrs []string
+	var queryArgs []interface{}
+	for _, line := range lines {
+		str, args := where(line)
+		queryStrs = append(queryStrs, "("+str+")")
+		queryArgs = append(queryArgs, args...)
+	}
+	return strings.Join(queryStrs, " or "), queryArgs
+}
+
 // UpdatePolicy updates a new policy rule to DB.
 func (a *Adapter) UpdatePolicy(sec string, ptype string, oldRule, newPolicy []string) error {
+	return a.UpdatePolicyCtx(context.Background(), sec, ptype, oldRule, newPolicy)
+}
+
+// UpdatePolicyCtx updates a new policy rule to DB.
+func (a *Adapter) UpdatePolicyCtx(ctx context.Context, sec string, ptype string, oldRule, newPolicy []string) error {
+	if err := a.checkRules(ptype, newPolicy); err != nil {
+		return err
+	}
 	oldLine := a.savePolicyLine(ptype, oldRule)
 	newLine := a.savePolicyLine(ptype, newPolicy)
-	return a.db.Model(&oldLine).Where(&oldLine).Updates(newLine).Error
+	return a.writeTx(ctx, func(tx *gorm.DB) error {
+		removed, added, _, err := a.updateRule(tx, oldLine, newLine)
+		if err != nil {
+			return err
+		}
+		return a.recordChange(tx, ChangeOpUpdate, removed, added)
+	})
 }
 
+// updateRule updates the rows matching oldLine to newLine within tx, and returns the number of rows updated,
+// counting the rows already equal to newLine.
+// If changes are tracked, it returns the rows updated too and, for each of them, the rule it was updated to.
+// If no-op errors are enabled, it fails with ErrPolicyNotFound if no row matches oldLine.
+func (a *Adapter) updateRule(tx *gorm.DB, oldLine CasbinRule, newLine CasbinRule) (removed []CasbinRule, added []CasbinRule, n int64, err error) {
+	str, args := a.ruleWhere(oldLine)
+	if a.softDelete {
+		// A deleted row equal to the new rule would conflict with the updated rows.
+		newStr, newArgs := a.exactWhere(newLine)
+		if err := tx.Unscoped().Where("deleted_at is not null").Where(newStr, newArgs...).Delete(a.getTableInstance()).Error; err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if a.tracksChanges() {
+		if removed, err = a.findRules(tx.Where(str, args...)); err != nil {
+			return nil, nil, 0, err
+		}
+		for range removed {
+			added = append(added, newLine)
+		}
+	}
+	result := tx.Model(a.getTableInstance()).Where(str, args...).Updates(a.updateColumns(newLine))
+	if result.Error != nil {
+		return nil, nil, 0, result.Error
+	}
+	n = result.RowsAffected
+	if n == 0 {
+		// MySQL doesn't count the rows already equal to the new rule as affected.
+		if err := tx.Model(a.getTableInstance()).Where(str, args...).Count(&n).Error; err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if n == 0 && a.noOpErrors {
+		return nil, nil, 0, ErrPolicyNotFound
+	}
+	return removed, added, n, nil
+}
+
+// UpdatePolicies updates some policy rules to DB.
 func (a *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return a.UpdatePoliciesCtx(context.Background(), sec, ptype, oldRules, newRules)
+}
+
+// UpdatePoliciesCtx updates some policy rules to DB.
+func (a *Adapter) UpdatePoliciesCtx(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	_, err := a.UpdatePoliciesAffected(ctx, sec, ptype, oldRules, newRules)
+	return err
+}
+
+// UpdatePoliciesAffected updates some policy rules to DB, and returns the number of rows updated.
+func (a *Adapter) UpdatePoliciesAffected(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) (int64, error) {
+	if err := a.checkRules(ptype, newRules...); err != nil {
+		return 0, err
+	}
 	oldPolicies := make([]CasbinRule, 0, len(oldRules))
 	newPolicies := make([]CasbinRule, 0, len(oldRules))
 	for _, oldRule := range oldRules {
@@ -1033,61 +1878,70 @@ func (a *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules []
 	for _, newRule := range newRules {
 		newPolicies = append(newPolicies, a.savePolicyLine(ptype, newRule))
 	}
-	tx := a.db.Begin()
-	for i := range oldPolicies {
-		if err := tx.Model(&oldPolicies[i]).Where(&oldPolicies[i]).Updates(newPolicies[i]).Error; err != nil {
-			tx.Rollback()
-			return err
+	var n int64
+	err := a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var removed, added []CasbinRule
+		for i := range oldPolicies {
+			oldRows, newRows, updated, err := a.updateRule(tx, oldPolicies[i], newPolicies[i])
+			if err != nil {
+				return err
+			}
+			removed, added = append(removed, oldRows...), append(added, newRows...)
+			n += updated
 		}
+		return a.recordChange(tx, ChangeOpUpdate, removed, added)
+	})
+	if err != nil {
+		return 0, err
 	}
-	return tx.Commit().Error
+	return n, nil
 }
 
+// UpdateFilteredPolicies deletes old rules and adds new rules.
 func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
-	// UpdateFilteredPolicies deletes old rules and adds new rules.
-	line := a.getTableInstance()
+	return a.UpdateFilteredPoliciesCtx(context.Background(), sec, ptype, newPolicies, fieldIndex, fieldValues...)
+}
 
-	line.Ptype = ptype
-	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
-		line.V0 = fieldValues[0-fieldIndex]
-	}
-	if fieldIndex <= 1 && 1 < fieldIndex+len(fieldValues) {
-		line.V1 = fieldValues[1-fieldIndex]
-	}
-	if fieldIndex <= 2 && 2 < fieldIndex+len(fieldValues) {
-		line.V2 = fieldValues[2-fieldIndex]
-	}
-	if fieldIndex <= 3 && 3 < fieldIndex+len(fieldValues) {
-		line.V3 = fieldValues[3-fieldIndex]
-	}
-	if fieldIndex <= 4 && 4 < fieldIndex+len(fieldValues) {
-		line.V4 = fieldValues[4-fieldIndex]
+// UpdateFilteredPoliciesCtx deletes old rules and adds new rules.
+func (a *Adapter) UpdateFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, newPolicies [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	if err := a.checkRules(ptype, newPolicies...); err != nil {
+		return nil, err
 	}
-	if fieldIndex <= 5 && 5 < fieldIndex+len(fieldValues) {
-		line.V5 = fieldValues[5-fieldIndex]
+	line, err := a.filteredRuleLine(ptype, fieldIndex, fieldValues)
+	if err != nil {
+		return nil, err
 	}
 
 	newP := make([]CasbinRule, 0, len(newPolicies))
-	oldP := make([]CasbinRule, 0)
 	for _, newRule := range newPolicies {
 		newP = append(newP, a.savePolicyLine(ptype, newRule))
 	}
 
-	tx := a.db.Begin()
-	str, args := line.queryString()
-	if err := tx.Where(str, args...).Find(&oldP).Error; err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	if err := tx.Where(str, args...).Delete([]CasbinRule{}).Error; err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	for i := range newP {
-		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&newP[i]).Error; err != nil {
-			tx.Rollback()
-			return nil, err
+	var oldP []CasbinRule
+	err = a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		str, args := line.queryString()
+		var err error
+		if oldP, err = a.findRules(tx.Where(str, args...)); err != nil {
+			return err
+		}
+		if len(oldP) == 0 && a.noOpErrors {
+			return ErrPolicyNotFound
+		}
+		if err := tx.Where(str, args...).Delete(a.getTableInstance()).Error; err != nil {
+			return err
 		}
+		var added []CasbinRule
+		for i := range newP {
+			inserted, _, err := a.insertRules(tx, newP[i:i+1])
+			if err != nil {
+				return err
+			}
+			added = append(added, inserted...)
+		}
+		return a.recordChange(tx, ChangeOpUpdateFiltered, oldP, added)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// return deleted rulues
@@ -1096,37 +1950,47 @@ func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newPolicies [
 		oldPolicy := v.toStringPolicy()
 		oldPolicies = append(oldPolicies, oldPolicy)
 	}
-	return oldPolicies, tx.Commit().Error
+	return oldPolicies, nil
 }
 
 func (a *Adapter) Copy() *Adapter {
 	oriAdapter := a.db
-	return &Adapter{
+	c := &Adapter{
 		db:             oriAdapter,
 		transactionMu:  a.transactionMu,
 		driverName:     a.driverName,
 		dataSourceName: a.dataSourceName,
 		databaseName:   a.databaseName,
+		schema:         a.schema,
 		tablePrefix:    a.tablePrefix,
 		tableName:      a.tableName,
 		dbSpecified:    a.dbSpecified,
 		isFiltered:     a.isFiltered,
+		fieldCount:     a.fieldCount,
+		columnSizes:    a.columnSizes,
 	}
+	c.copySettings(a)
+	return c
+}
+
+// copySettings copies the settings changed after construction from another adapter.
+func (a *Adapter) copySettings(from *Adapter) {
+	a.strict = from.strict
+	a.exactMatch = from.exactMatch
+	a.noOpErrors = from.noOpErrors
+	a.loadBatchSize = from.loadBatchSize
+	a.changeLogTable = from.changeLogTable
+	a.auditTable = from.auditTable
+	a.softDelete = from.softDelete
+	a.snapshotTable = from.snapshotTable
+	a.definitions.Store(from.definitions.Load())
 }
 
 // Preview Pre-checking to avoid causing partial load success and partial failure deep
 func (a *Adapter) Preview(rules *[]CasbinRule, model model.Model) error {
 	j := 0
 	for i, rule := range *rules {
-		r := []string{rule.Ptype,
-			rule.V0, rule.V1, rule.V2,
-			rule.V3, rule.V4, rule.V5}
-		index := len(r) - 1
-		for r[index] == "" {
-			index--
-		}
-		index += 1
-		p := r[:index]
+		p := rule.policyArray()
 		key := p[0]
 		sec := key[:1]
 		ok, err := model.HasPolicyEx(sec, key, p[1:])
@@ -1147,61 +2011,251 @@ func (a *Adapter) GetDb() *gorm.DB {
 }
 
 func (c *CasbinRule) queryString() (interface{}, []interface{}) {
-	queryArgs := []interface{}{c.Ptype}
+	return appendWhere(*c)
+}
 
-	queryStr := "ptype = ?"
-	if c.V0 != "" {
-		queryStr += " and v0 = ?"
-		queryArgs = append(queryArgs, c.V0)
+func (c *CasbinRule) toStringPolicy() []string {
+	policy := make([]string, 0)
+	if c.Ptype != "" {
+		policy = append(policy, c.Ptype)
 	}
-	if c.V1 != "" {
-		queryStr += " and v1 = ?"
-		queryArgs = append(queryArgs, c.V1)
+	for _, v := range c.values() {
+		if v != "" {
+			policy = append(policy, v)
+		}
 	}
-	if c.V2 != "" {
-		queryStr += " and v2 = ?"
-		queryArgs = append(queryArgs, c.V2)
+	return policy
+}
+
+// matchesAny returns whether one of the rows is matched by the rule.
+// Unless exact is true, empty values of the rule match any value.
+func (c *CasbinRule) matchesAny(rows []CasbinRule, exact bool) bool {
+	values := c.values()
+	for _, row := range rows {
+		if row.Ptype != c.Ptype {
+			continue
+		}
+		rowValues := row.values()
+		matched := true
+		for i := 0; i < max(len(values), len(rowValues)); i++ {
+			v, rowValue := "", ""
+			if i < len(values) {
+				v = values[i]
+			}
+			if i < len(rowValues) {
+				rowValue = rowValues[i]
+			}
+			if (exact || v != "") && rowValue != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
 	}
-	if c.V3 != "" {
-		queryStr += " and v3 = ?"
-		queryArgs = append(queryArgs, c.V3)
+	return false
+}
+
+// values returns all value fields of the rule, v0 first.
+func (c *CasbinRule) values() []string {
+	return append([]string{c.V0, c.V1, c.V2, c.V3, c.V4, c.V5}, c.ExtraV...)
+}
+
+// setValues sets the value fields of the rule, v0 first.
+func (c *CasbinRule) setValues(values []string) {
+	fields := []*string{&c.V0, &c.V1, &c.V2, &c.V3, &c.V4, &c.V5}
+	for i, v := range values {
+		if i < len(fields) {
+			*fields[i] = v
+		}
 	}
-	if c.V4 != "" {
-		queryStr += " and v4 = ?"
-		queryArgs = append(queryArgs, c.V4)
+	c.ExtraV = nil
+	if len(values) > len(fields) {
+		c.ExtraV = append([]string(nil), values[len(fields):]...)
 	}
-	if c.V5 != "" {
-		queryStr += " and v5 = ?"
-		queryArgs = append(queryArgs, c.V5)
+}
+
+// policyArray returns the ptype and the values of the rule without trailing empty values.
+func (c *CasbinRule) policyArray() []string {
+	p := append([]string{c.Ptype}, c.values()...)
+
+	index := len(p) - 1
+	for p[index] == "" {
+		index--
 	}
+	index += 1
+	return p[:index]
+}
 
-	return queryStr, queryArgs
+var casbinRuleType = reflect.TypeOf(CasbinRule{})
+
+var deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+
+// ruleTypes caches the generated row types by field count and soft delete mode.
+var ruleTypes sync.Map
+
+type ruleTypeKey struct {
+	n          int
+	softDelete bool
+	sizes      ColumnSizes
 }
 
-func (c *CasbinRule) toStringPolicy() []string {
-	policy := make([]string, 0)
-	if c.Ptype != "" {
-		policy = append(policy, c.Ptype)
+// ruleTypeOf returns a row type with the columns of CasbinRule and n value columns of the given sizes,
+// and a deleted_at column if softDelete is true.
+func ruleTypeOf(n int, softDelete bool, sizes ColumnSizes) reflect.Type {
+	key := ruleTypeKey{n, softDelete, sizes}
+	if t, ok := ruleTypes.Load(key); ok {
+		return t.(reflect.Type)
 	}
-	if c.V0 != "" {
-		policy = append(policy, c.V0)
+
+	stringType := reflect.TypeOf("")
+	fields := []reflect.StructField{
+		{Name: "ID", Type: reflect.TypeOf(uint(0)), Tag: `gorm:"primaryKey;autoIncrement"`},
+		{Name: "Ptype", Type: stringType, Tag: reflect.StructTag(fmt.Sprintf(`gorm:"size:%d"`, sizes.Ptype))},
 	}
-	if c.V1 != "" {
-		policy = append(policy, c.V1)
+	for i := 0; i < n; i++ {
+		tag := reflect.StructTag(fmt.Sprintf(`gorm:"size:%d"`, sizes.Value))
+		fields = append(fields, reflect.StructField{Name: fmt.Sprintf("V%d", i), Type: stringType, Tag: tag})
 	}
-	if c.V2 != "" {
-		policy = append(policy, c.V2)
+	if softDelete {
+		fields = append(fields, reflect.StructField{Name: "DeletedAt", Type: deletedAtType})
 	}
-	if c.V3 != "" {
-		policy = append(policy, c.V3)
+	t, _ := ruleTypes.LoadOrStore(key, reflect.StructOf(fields))
+	return t.(reflect.Type)
+}
+
+// countValueFields returns the number of value fields (V0, V1, ...) of a custom table.
+func countValueFields(t interface{}) int {
+	rt := reflect.Indirect(reflect.ValueOf(t)).Type()
+	if rt.Kind() != reflect.Struct {
+		return 0
 	}
-	if c.V4 != "" {
-		policy = append(policy, c.V4)
+	n := 0
+	for {
+		if _, ok := rt.FieldByName(fmt.Sprintf("V%d", n)); !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// ruleLayout holds the field indexes of a row type.
+type ruleLayout struct {
+	id        []int
+	ptype     []int
+	values    [][]int
+	deletedAt []int
+}
+
+var ruleLayouts sync.Map
+
+func layoutOf(t reflect.Type) *ruleLayout {
+	if l, ok := ruleLayouts.Load(t); ok {
+		return l.(*ruleLayout)
 	}
-	if c.V5 != "" {
-		policy = append(policy, c.V5)
+
+	l := &ruleLayout{}
+	if f, ok := t.FieldByName("ID"); ok {
+		l.id = f.Index
 	}
-	return policy
+	if f, ok := t.FieldByName("Ptype"); ok {
+		l.ptype = f.Index
+	}
+	if f, ok := t.FieldByName("DeletedAt"); ok && f.Type == deletedAtType {
+		l.deletedAt = f.Index
+	}
+	for i := 0; ; i++ {
+		f, ok := t.FieldByName(fmt.Sprintf("V%d", i))
+		if !ok {
+			break
+		}
+		l.values = append(l.values, f.Index)
+	}
+	v, _ := ruleLayouts.LoadOrStore(t, l)
+	return v.(*ruleLayout)
+}
+
+// toRows converts lines to a pointer to a slice of the table type, ready for db.Create.
+func (a *Adapter) toRows(lines []CasbinRule) interface{} {
+	t := a.getTableType()
+	if t == casbinRuleType {
+		return &lines
+	}
+
+	l := layoutOf(t)
+	rows := reflect.New(reflect.SliceOf(t))
+	rows.Elem().Set(reflect.MakeSlice(rows.Elem().Type(), len(lines), len(lines)))
+	for i, line := range lines {
+		row := rows.Elem().Index(i)
+		if l.ptype != nil {
+			row.FieldByIndex(l.ptype).SetString(line.Ptype)
+		}
+		values := line.values()
+		for j, index := range l.values {
+			if j < len(values) {
+				row.FieldByIndex(index).SetString(values[j])
+			}
+		}
+	}
+	return rows.Interface()
+}
+
+// findRules runs db.Find on the table and converts the rows to CasbinRule.
+func (a *Adapter) findRules(db *gorm.DB) ([]CasbinRule, error) {
+	t := a.getTableType()
+	if t == casbinRuleType {
+		var lines []CasbinRule
+		err := db.Find(&lines).Error
+		return lines, err
+	}
+
+	rows := reflect.New(reflect.SliceOf(t))
+	if err := db.Find(rows.Interface()).Error; err != nil {
+		return nil, err
+	}
+
+	l := layoutOf(t)
+	lines := make([]CasbinRule, rows.Elem().Len())
+	for i := range lines {
+		lines[i] = l.toLine(rows.Elem().Index(i))
+	}
+	return lines, nil
+}
+
+// toLine converts a row of the table type to CasbinRule.
+func (l *ruleLayout) toLine(row reflect.Value) CasbinRule {
+	var line CasbinRule
+	if l.id != nil {
+		if id := row.FieldByIndex(l.id); id.CanUint() {
+			line.ID = uint(id.Uint())
+		} else if id.CanInt() {
+			line.ID = uint(id.Int())
+		}
+	}
+	if l.ptype != nil {
+		line.Ptype = row.FieldByIndex(l.ptype).String()
+	}
+	values := make([]string, len(l.values))
+	for j, index := range l.values {
+		values[j] = row.FieldByIndex(index).String()
+	}
+	line.setValues(values)
+	return line
+}
+
+// updateColumns returns the value columns of line, for use with db.Updates.
+func (a *Adapter) updateColumns(line CasbinRule) map[string]interface{} {
+	columns := make(map[string]interface{})
+	values := line.values()
+	for i := 0; i < a.getFieldCount(); i++ {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		columns[fmt.Sprintf("v%d", i)] = v
+	}
+	return columns
 }
 
 // CombineType represents different types of condition combining strategies
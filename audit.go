@@ -0,0 +1,182 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// AuditEntry is an entry of the audit trail, recording the change of one rule.
+// OldRule is empty for an added rule, and NewRule for a removed one.
+type AuditEntry struct {
+	ID        uint     `gorm:"primaryKey;autoIncrement"`
+	Operation ChangeOp `gorm:"size:32"`
+	Sec       string   `gorm:"size:8"`
+	Ptype     string   `gorm:"size:100"`
+	Subject   string   `gorm:"size:100"`
+	OldRule   []string `gorm:"serializer:json"`
+	NewRule   []string `gorm:"serializer:json"`
+	Actor     string   `gorm:"size:255"`
+	CreatedAt time.Time
+}
+
+// AuditFilter selects audit entries. The zero value of a field matches every entry.
+type AuditFilter struct {
+	// From and To bound the time of the entries, From included and To excluded.
+	From time.Time
+	To   time.Time
+	// Subject matches the first value of the old rule, or of the new rule if there is none.
+	Subject string
+	Ptype   string
+	// Limit is the maximum number of entries returned.
+	Limit int
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor recorded in the audit trail
+// for the changes made with the Ctx methods of the adapter.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// EnableAudit makes the adapter write an audit entry for every rule it changes,
+// within the transaction of the change. The table is named after the policy table with an "_audit" suffix.
+func (a *Adapter) EnableAudit(enable bool) error {
+	if !enable {
+		a.auditTable = ""
+		return nil
+	}
+
+	table := a.getFullTableName() + "_audit"
+	if a.db.Statement.Context.Value(disableMigrateKey) == nil {
+		db := a.db.Session(&gorm.Session{NewDB: true})
+		entry := reflect.New(auditEntryType(a.getColumnSizes())).Interface()
+		if err := db.Table(table).AutoMigrate(entry); err != nil {
+			return err
+		}
+		for _, column := range []string{"created_at", "subject", "ptype"} {
+			if err := createIndex(db, table, column); err != nil {
+				return err
+			}
+		}
+	}
+	a.auditTable = table
+	return nil
+}
+
+// auditEntryType returns the type the audit table is migrated with: AuditEntry,
+// with Ptype and Subject columns as large as the ptype and value columns of the policy table.
+func auditEntryType(sizes ColumnSizes) reflect.Type {
+	t := reflect.TypeOf(AuditEntry{})
+	if sizes == defaultColumnSizes {
+		return t
+	}
+
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i)
+		switch fields[i].Name {
+		case "Ptype":
+			fields[i].Tag = reflect.StructTag(fmt.Sprintf(`gorm:"size:%d"`, sizes.Ptype))
+		case "Subject":
+			fields[i].Tag = reflect.StructTag(fmt.Sprintf(`gorm:"size:%d"`, sizes.Value))
+		}
+	}
+	return reflect.StructOf(fields)
+}
+
+// auditChange writes an audit entry for each rule changed.
+func (a *Adapter) auditChange(db *gorm.DB, op ChangeOp, removed []CasbinRule, added []CasbinRule) error {
+	if a.auditTable == "" {
+		return nil
+	}
+
+	actor := actorFrom(db.Statement.Context)
+	now := time.Now()
+	var entries []AuditEntry
+	newEntry := func(oldLine, newLine *CasbinRule) {
+		entry := AuditEntry{Operation: op, Actor: actor, CreatedAt: now}
+		if newLine != nil {
+			p := newLine.policyArray()
+			entry.Ptype, entry.Subject, entry.NewRule = p[0], newLine.V0, p[1:]
+		}
+		if oldLine != nil {
+			p := oldLine.policyArray()
+			entry.Ptype, entry.Subject, entry.OldRule = p[0], oldLine.V0, p[1:]
+		}
+		entry.Sec = entry.Ptype[:1]
+		entries = append(entries, entry)
+	}
+
+	if op == ChangeOpUpdate {
+		for i := range removed {
+			newEntry(&removed[i], &added[i])
+		}
+	} else {
+		for i := range removed {
+			newEntry(&removed[i], nil)
+		}
+		for i := range added {
+			newEntry(nil, &added[i])
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return db.Table(a.auditTable).CreateInBatches(entries, 1000).Error
+}
+
+// AuditEntries returns the entries of the audit trail selected by the filter, oldest first.
+func (a *Adapter) AuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if a.auditTable == "" {
+		return nil, errors.New("the audit trail is not enabled")
+	}
+
+	db := a.db.WithContext(ctx).Session(&gorm.Session{NewDB: true}).Table(a.auditTable)
+	if !filter.From.IsZero() {
+		db = db.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		db = db.Where("created_at < ?", filter.To)
+	}
+	if filter.Subject != "" {
+		db = db.Where("subject = ?", filter.Subject)
+	}
+	if filter.Ptype != "" {
+		db = db.Where("ptype = ?", filter.Ptype)
+	}
+	if filter.Limit > 0 {
+		db = db.Limit(filter.Limit)
+	}
+
+	var entries []AuditEntry
+	err := db.Order("id").Find(&entries).Error
+	return entries, err
+}
@@ -0,0 +1,278 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/casbin/casbin/v3/model"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ChangeOp is the kind of policy change recorded in the change log.
+type ChangeOp string
+
+const (
+	ChangeOpAdd            ChangeOp = "add"
+	ChangeOpRemove         ChangeOp = "remove"
+	ChangeOpUpdate         ChangeOp = "update"
+	ChangeOpRemoveFiltered ChangeOp = "remove_filtered"
+	ChangeOpUpdateFiltered ChangeOp = "update_filtered"
+	ChangeOpSave           ChangeOp = "save"
+	ChangeOpSaveDiff       ChangeOp = "save_diff"
+	ChangeOpRestore        ChangeOp = "restore"
+	ChangeOpRollback       ChangeOp = "rollback"
+)
+
+// Change is an entry of the change log.
+// Removed and Added hold the rules as ptype followed by their values.
+// The rules of a ChangeOpSave entry are not recorded, the whole policy has to be reloaded.
+type Change struct {
+	Seq       uint64
+	Op        ChangeOp
+	Removed   [][]string
+	Added     [][]string
+	CreatedAt time.Time
+}
+
+// changeRow is a row of the change log table.
+type changeRow struct {
+	Seq       uint64   `gorm:"primaryKey;autoIncrement:false"`
+	Op        ChangeOp `gorm:"size:32"`
+	Removed   string
+	Added     string
+	CreatedAt time.Time
+}
+
+// seqRow is the single row of a sequence table, holding the last sequence number of a table.
+// Incrementing it locks the row until the transaction ends,
+// so the rows are committed in the order of their sequence numbers,
+// which an auto-increment column doesn't guarantee.
+type seqRow struct {
+	ID  uint `gorm:"primaryKey;autoIncrement:false"`
+	Seq uint64
+}
+
+// createSeqTable creates the sequence table of table.
+func createSeqTable(db *gorm.DB, table string) error {
+	if err := db.Table(table + "_seq").AutoMigrate(&seqRow{}); err != nil {
+		return err
+	}
+	return db.Table(table + "_seq").Clauses(dialectOf(db, "").IgnoreConflict()).Create(&seqRow{ID: 1}).Error
+}
+
+// nextSeq increments the sequence number of table within tx and returns it.
+func nextSeq(tx *gorm.DB, table string) (uint64, error) {
+	if err := tx.Table(table+"_seq").Where("id = ?", 1).UpdateColumn("seq", gorm.Expr("seq + ?", 1)).Error; err != nil {
+		return 0, err
+	}
+	return lastSeq(tx, table)
+}
+
+// lastSeq returns the last sequence number of table.
+func lastSeq(db *gorm.DB, table string) (uint64, error) {
+	var seq uint64
+	err := db.Table(table+"_seq").Select("seq").Where("id = ?", 1).Scan(&seq).Error
+	return seq, err
+}
+
+// EnableChangeLog makes the adapter record every policy change in a change log table,
+// within the transaction of the change. The table is named after the policy table with a "_changes" suffix.
+// Use LoadChanges to apply the changes made after a sequence number to a model.
+func (a *Adapter) EnableChangeLog(enable bool) error {
+	if !enable {
+		a.changeLogTable = ""
+		return nil
+	}
+
+	table := a.getFullTableName() + "_changes"
+	if a.db.Statement.Context.Value(disableMigrateKey) == nil {
+		db := a.db.Session(&gorm.Session{NewDB: true})
+		if err := db.Table(table).AutoMigrate(&changeRow{}); err != nil {
+			return err
+		}
+		if err := createSeqTable(db, table); err != nil {
+			return err
+		}
+	}
+	a.changeLogTable = table
+	return nil
+}
+
+// tracksChanges returns whether the changes have to be recorded,
+// in which case the removed rules are read before being deleted.
+func (a *Adapter) tracksChanges() bool {
+	return a.changeLogTable != "" || a.auditTable != "" || a.dryRun != nil
+}
+
+// writeTx runs fc in a transaction if changes are tracked, so they are recorded with the change.
+func (a *Adapter) writeTx(ctx context.Context, fc func(tx *gorm.DB) error) error {
+	db := a.db.WithContext(ctx)
+	if !a.tracksChanges() {
+		return fc(db)
+	}
+	return db.Transaction(fc)
+}
+
+// recordChange records the change in the change log and the audit trail if they are enabled.
+// tx must be the transaction of the change. For an update, removed[i] was updated to added[i].
+func (a *Adapter) recordChange(tx *gorm.DB, op ChangeOp, removed []CasbinRule, added []CasbinRule) error {
+	if a.dryRun != nil {
+		a.dryRun.add(op, removed, added)
+	}
+	db := tx.Session(&gorm.Session{NewDB: true})
+	if err := a.logChange(db, op, removed, added); err != nil {
+		return err
+	}
+	return a.auditChange(db, op, removed, added)
+}
+
+// logChange writes the change to the change log.
+func (a *Adapter) logChange(db *gorm.DB, op ChangeOp, removed []CasbinRule, added []CasbinRule) error {
+	if a.changeLogTable == "" {
+		return nil
+	}
+
+	seq, err := nextSeq(db, a.changeLogTable)
+	if err != nil {
+		return err
+	}
+
+	row := changeRow{Seq: seq, Op: op, CreatedAt: time.Now()}
+	if op != ChangeOpSave {
+		if row.Removed, err = marshalRules(removed); err != nil {
+			return err
+		}
+		if row.Added, err = marshalRules(added); err != nil {
+			return err
+		}
+	}
+	return db.Table(a.changeLogTable).Create(&row).Error
+}
+
+func marshalRules(lines []CasbinRule) (string, error) {
+	rules := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		rules = append(rules, line.policyArray())
+	}
+	b, err := json.Marshal(rules)
+	return string(b), err
+}
+
+// LastChangeSeq returns the sequence number of the last change recorded in the change log.
+// Read it before loading the policy, and pass it to LoadChanges to catch up from there.
+func (a *Adapter) LastChangeSeq(ctx context.Context) (uint64, error) {
+	if a.changeLogTable == "" {
+		return 0, errors.New("the change log is not enabled")
+	}
+
+	return lastSeq(a.db.WithContext(ctx).Session(&gorm.Session{NewDB: true}), a.changeLogTable)
+}
+
+// Changes returns the entries of the change log after the sequence number afterSeq, in order.
+func (a *Adapter) Changes(ctx context.Context, afterSeq uint64) ([]Change, error) {
+	if a.changeLogTable == "" {
+		return nil, errors.New("the change log is not enabled")
+	}
+
+	var rows []changeRow
+	err := a.db.WithContext(ctx).Session(&gorm.Session{NewDB: true}).Table(a.changeLogTable).Where("seq > ?", afterSeq).Order("seq").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0, len(rows))
+	for _, row := range rows {
+		change := Change{Seq: row.Seq, Op: row.Op, CreatedAt: row.CreatedAt}
+		if row.Removed != "" {
+			if err := json.Unmarshal([]byte(row.Removed), &change.Removed); err != nil {
+				return nil, errors.Wrapf(err, "invalid change %d", row.Seq)
+			}
+		}
+		if row.Added != "" {
+			if err := json.Unmarshal([]byte(row.Added), &change.Added); err != nil {
+				return nil, errors.Wrapf(err, "invalid change %d", row.Seq)
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// LoadChanges applies the changes recorded after the sequence number afterSeq to the model,
+// and returns the sequence number of the last change applied.
+// If one of them saved the whole policy, the policy is reloaded instead.
+// The role links of the enforcer have to be rebuilt if grouping rules changed.
+func (a *Adapter) LoadChanges(model model.Model, afterSeq uint64) (uint64, error) {
+	return a.LoadChangesCtx(context.Background(), model, afterSeq)
+}
+
+// LoadChangesCtx applies the changes recorded after the sequence number afterSeq to the model,
+// and returns the sequence number of the last change applied.
+// If one of them saved the whole policy, the policy is reloaded instead.
+// The role links of the enforcer have to be rebuilt if grouping rules changed.
+func (a *Adapter) LoadChangesCtx(ctx context.Context, model model.Model, afterSeq uint64) (uint64, error) {
+	changes, err := a.Changes(ctx, afterSeq)
+	if err != nil {
+		return afterSeq, err
+	}
+	if len(changes) == 0 {
+		return afterSeq, nil
+	}
+	lastSeq := changes[len(changes)-1].Seq
+
+	for _, change := range changes {
+		if change.Op == ChangeOpSave {
+			model.ClearPolicy()
+			if err := a.LoadPolicyCtx(ctx, model); err != nil {
+				return afterSeq, err
+			}
+			// The reloaded policy includes the later changes.
+			return lastSeq, nil
+		}
+	}
+
+	for _, change := range changes {
+		if err := ApplyChange(model, change); err != nil {
+			return afterSeq, err
+		}
+	}
+	return lastSeq, nil
+}
+
+// ApplyChange applies the rules removed and added by a change to the model.
+// Applying a change twice has no further effect.
+func ApplyChange(model model.Model, change Change) error {
+	for _, p := range change.Removed {
+		if len(p) == 0 {
+			continue
+		}
+		if _, err := model.RemovePoliciesWithAffected(p[0][:1], p[0], [][]string{p[1:]}); err != nil {
+			return err
+		}
+	}
+	for _, p := range change.Added {
+		if len(p) == 0 {
+			continue
+		}
+		if _, err := model.AddPoliciesWithAffected(p[0][:1], p[0], [][]string{p[1:]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
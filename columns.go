@@ -0,0 +1,187 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultColumnSize = 100
+	// ruleHashColumn is the generated column holding the hash of a rule,
+	// used for the unique index when the index over the columns would be too long.
+	ruleHashColumn = "rule_hash"
+)
+
+// indexKeyLimit is the limit of the length of an index key on a database.
+type indexKeyLimit struct {
+	// maxLength is the maximum length of a key in bytes.
+	maxLength int
+	// charBytes is the number of bytes counted for a character of a column.
+	charBytes int
+	// ruleHash returns the clause of ALTER TABLE adding the generated column of the SHA-256 hash of a rule,
+	// given the quoted name of the column and the quoted value columns.
+	ruleHash func(column string, values []string) string
+}
+
+// indexKeyLimits holds the limits of the databases on which the unique index is moved to a hash of the rule
+// if an index over the columns would exceed them.
+var indexKeyLimits = map[string]indexKeyLimit{
+	// InnoDB, with 4 bytes per utf8mb4 character.
+	"mysql": {maxLength: 3072, charBytes: 4, ruleHash: func(column string, values []string) string {
+		return fmt.Sprintf("ADD COLUMN %s BINARY(32) AS (UNHEX(SHA2(CONCAT_WS(CHAR(0), %s), 256))) STORED", column, strings.Join(values, ","))
+	}},
+	// A nonclustered index, with 2 bytes per nvarchar character.
+	// The concatenation is NVARCHAR(MAX), as it would be truncated to 4000 characters otherwise.
+	"sqlserver": {maxLength: 1700, charBytes: 2, ruleHash: func(column string, values []string) string {
+		concat := "CAST(" + values[0] + " AS NVARCHAR(MAX))"
+		for _, value := range values[1:] {
+			concat += " + NCHAR(0) + " + value
+		}
+		return fmt.Sprintf("ADD %s AS CAST(HASHBYTES('SHA2_256', %s) AS BINARY(32)) PERSISTED", column, concat)
+	}},
+	// A B-tree entry, with 3 bytes per UTF-8 character of the Basic Multilingual Plane.
+	// Text can't hold a NUL character, the values are separated by chr(1).
+	// The cast to bytea parses backslash escapes, the backslashes are doubled for it to keep the bytes of the text.
+	"postgres": {maxLength: 2704, charBytes: 3, ruleHash: func(column string, values []string) string {
+		concat := strings.Join(values, " || chr(1) || ")
+		return fmt.Sprintf("ADD COLUMN %s bytea GENERATED ALWAYS AS (sha256(replace(%s, chr(92), chr(92) || chr(92))::bytea)) STORED", column, concat)
+	}},
+}
+
+// ColumnSizes sets the sizes of the columns of the policy table, in characters.
+// A zero size means the default of 100.
+type ColumnSizes struct {
+	Ptype int
+	// Value is the size of each value column, v0, v1 ...
+	Value int
+}
+
+var defaultColumnSizes = ColumnSizes{Ptype: defaultColumnSize, Value: defaultColumnSize}
+
+// getColumnSizes returns the sizes of the columns of the table.
+func (a *Adapter) getColumnSizes() ColumnSizes {
+	sizes := a.columnSizes
+	if sizes.Ptype == 0 {
+		sizes.Ptype = defaultColumnSize
+	}
+	if sizes.Value == 0 {
+		sizes.Value = defaultColumnSize
+	}
+	return sizes
+}
+
+// uniqueIndexName returns the name of the unique index of the table.
+func (a *Adapter) uniqueIndexName() string {
+	return indexName(a.getFullTableName(), "")
+}
+
+// usesRuleHash returns whether the unique index of the table is on a hash of the rule,
+// which is the case on MySQL, SQL Server and Postgres when an index over the columns
+// would exceed the key length limit of the database, see indexKeyLimits.
+func (a *Adapter) usesRuleHash() bool {
+	limit, ok := indexKeyLimits[a.db.Dialector.Name()]
+	if !ok {
+		return false
+	}
+	sizes := a.getColumnSizes()
+	return limit.charBytes*(sizes.Ptype+a.getFieldCount()*sizes.Value) > limit.maxLength
+}
+
+func (a *Adapter) valueColumns() []string {
+	columns := []string{"ptype"}
+	for i := 0; i < a.getFieldCount(); i++ {
+		columns = append(columns, valueColumn(i))
+	}
+	return columns
+}
+
+// createUniqueIndex creates the unique index of the table if it doesn't exist.
+// The index is on a generated column holding the SHA-256 hash of the rule
+// if an index over the columns would be too long.
+func (a *Adapter) createUniqueIndex() error {
+	tableName := a.getFullTableName()
+	index := a.uniqueIndexName()
+	t := a.getTableInstance()
+	q := a.db.Statement.Quote
+	var quoted []string
+	for _, column := range a.valueColumns() {
+		quoted = append(quoted, q(column))
+	}
+	columns := strings.Join(quoted, ",")
+	if a.usesRuleHash() {
+		if !a.db.Migrator().HasColumn(t, ruleHashColumn) {
+			ruleHash := indexKeyLimits[a.db.Dialector.Name()].ruleHash(q(ruleHashColumn), quoted)
+			if err := a.db.Exec(fmt.Sprintf("ALTER TABLE %s %s", q(tableName), ruleHash)).Error; err != nil {
+				return err
+			}
+		}
+		columns = q(ruleHashColumn)
+	}
+
+	if a.db.Migrator().HasIndex(t, index) {
+		return nil
+	}
+	return a.db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", q(index), q(tableName), columns)).Error
+}
+
+// WidenColumns alters the columns of an existing table to the sizes the adapter was created with,
+// see NewAdapterByDBWithColumnSizes. Values longer than 100 characters are truncated or rejected
+// by MySQL otherwise, depending on its strict mode.
+// The unique index is moved to a hash of the rule if it would exceed the key length limit of the database.
+// SQLite doesn't enforce column sizes, so the table is left as is.
+func (a *Adapter) WidenColumns(ctx context.Context) error {
+	if a.db.Statement.Context.Value(customTableKey) != nil {
+		return errors.New("the columns of a custom table are set by its type")
+	}
+	db := a.db.WithContext(ctx)
+	if db.Dialector.Name() == "sqlite" {
+		return nil
+	}
+
+	t := a.getTableInstance()
+	m := db.Migrator()
+	name := db.Dialector.Name()
+	index := a.uniqueIndexName()
+	hashed := m.HasColumn(t, ruleHashColumn)
+	// SQL Server and Postgres don't alter the columns a generated column is computed from,
+	// SQL Server doesn't alter indexed columns either,
+	// and an index over the columns may not hold the widened columns.
+	if m.HasIndex(t, index) && (hashed && name != "mysql" || !hashed && (a.usesRuleHash() || name == "sqlserver")) {
+		if err := m.DropIndex(t, index); err != nil {
+			return err
+		}
+	}
+	if hashed && name != "mysql" {
+		if err := m.DropColumn(t, ruleHashColumn); err != nil {
+			return err
+		}
+	}
+
+	fields := []string{"Ptype"}
+	for i := 0; i < a.getFieldCount(); i++ {
+		fields = append(fields, fmt.Sprintf("V%d", i))
+	}
+	for _, field := range fields {
+		if err := m.AlterColumn(t, field); err != nil {
+			return errors.Wrapf(err, "failed to widen column %s", strings.ToLower(field))
+		}
+	}
+	return a.createUniqueIndex()
+}
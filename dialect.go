@@ -0,0 +1,203 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pkg/errors"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Dialect holds what the adapter does differently on a database.
+// Register a Dialect with RegisterDialect to use the database with NewAdapter and WithDriver.
+type Dialect interface {
+	// Open returns the Gorm dialector connecting to the data source.
+	Open(dataSourceName string) gorm.Dialector
+	// CreateDatabase creates the database if it doesn't exist,
+	// db being connected to the data source without a database.
+	// Quote the name with db.Statement.Quote.
+	CreateDatabase(db *gorm.DB, databaseName string) error
+	// DataSourceWithDatabase returns the data source connecting to the database,
+	// replacing the database it specifies if any.
+	DataSourceWithDatabase(dataSourceName string, databaseName string) (string, error)
+	// TruncateTable empties the table using db, which may be a transaction
+	// the emptying has to be rolled back with.
+	// The table may be qualified by a schema, quote it with db.Statement.Quote.
+	TruncateTable(db *gorm.DB, table string) error
+	// IgnoreConflict returns the clause making an insert skip the rows conflicting with a unique index.
+	IgnoreConflict() clause.Expression
+}
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = map[string]Dialect{}
+)
+
+func init() {
+	RegisterDialect("postgres", postgresDialect{})
+	RegisterDialect("mysql", mysqlDialect{})
+	RegisterDialect("sqlserver", sqlserverDialect{})
+	RegisterDialect("sqlite3", sqliteDialect{})
+	// The name of the Gorm dialector, for the instances passed to NewAdapterByDB.
+	RegisterDialect("sqlite", sqliteDialect{})
+}
+
+// RegisterDialect makes the dialect available under the driver name,
+// replacing the dialect registered under that name if any.
+// Register it under the name of its Gorm dialector too, so it is used for the Gorm instances passed to NewAdapterByDB.
+func RegisterDialect(driverName string, d Dialect) {
+	if d == nil {
+		panic("gormadapter: RegisterDialect dialect is nil")
+	}
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	dialects[driverName] = d
+}
+
+// lookupDialect returns the dialect registered under the driver name.
+func lookupDialect(driverName string) (Dialect, error) {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	if d, ok := dialects[driverName]; ok {
+		return d, nil
+	}
+
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, errors.Errorf("database dialect %q is not supported, supported databases are %s", driverName, strings.Join(names, ", "))
+}
+
+// dialectOf returns the dialect of the driver name, or of the Gorm dialector of db if it is empty.
+// An unregistered Gorm dialector gets the defaults of the SQL standard.
+func dialectOf(db *gorm.DB, driverName string) Dialect {
+	if driverName == "" {
+		driverName = db.Dialector.Name()
+	}
+	if d, err := lookupDialect(driverName); err == nil {
+		return d
+	}
+	return standardDialect{}
+}
+
+// standardDialect is the dialect of the Gorm instances of unregistered drivers, opened by the user.
+type standardDialect struct{}
+
+func (standardDialect) Open(string) gorm.Dialector {
+	return nil
+}
+
+func (standardDialect) CreateDatabase(db *gorm.DB, databaseName string) error {
+	return db.Exec("CREATE DATABASE IF NOT EXISTS " + db.Statement.Quote(databaseName)).Error
+}
+
+func (standardDialect) DataSourceWithDatabase(dataSourceName string, databaseName string) (string, error) {
+	return dataSourceName + databaseName, nil
+}
+
+// TruncateTable deletes the rows, as TRUNCATE may not be rolled back.
+func (standardDialect) TruncateTable(db *gorm.DB, table string) error {
+	return db.Exec("delete from " + db.Statement.Quote(table)).Error
+}
+
+func (standardDialect) IgnoreConflict() clause.Expression {
+	return clause.OnConflict{DoNothing: true}
+}
+
+type postgresDialect struct {
+	standardDialect
+}
+
+func (postgresDialect) Open(dataSourceName string) gorm.Dialector {
+	return postgres.Open(dataSourceName)
+}
+
+func (postgresDialect) CreateDatabase(db *gorm.DB, databaseName string) error {
+	err := db.Exec("CREATE DATABASE " + db.Statement.Quote(databaseName)).Error
+	// 42P04 is	duplicate_database
+	if err != nil && strings.Contains(err.Error(), "42P04") {
+		return nil
+	}
+	return err
+}
+
+func (postgresDialect) DataSourceWithDatabase(dataSourceName string, databaseName string) (string, error) {
+	return postgresDSNWithDatabase(dataSourceName, databaseName)
+}
+
+func (postgresDialect) TruncateTable(db *gorm.DB, table string) error {
+	return db.Exec("truncate table " + db.Statement.Quote(table) + " RESTART IDENTITY").Error
+}
+
+// mysqlDialect deletes the rows of a table to empty it: MySQL commits the transaction implicitly on TRUNCATE.
+type mysqlDialect struct {
+	standardDialect
+}
+
+func (mysqlDialect) Open(dataSourceName string) gorm.Dialector {
+	return mysql.Open(dataSourceName)
+}
+
+func (mysqlDialect) DataSourceWithDatabase(dataSourceName string, databaseName string) (string, error) {
+	return mysqlDSNWithDatabase(dataSourceName, databaseName)
+}
+
+type sqlserverDialect struct {
+	standardDialect
+}
+
+func (sqlserverDialect) Open(dataSourceName string) gorm.Dialector {
+	return sqlserver.Open(dataSourceName)
+}
+
+// CreateDatabase doesn't create the database, which has to exist.
+func (sqlserverDialect) CreateDatabase(*gorm.DB, string) error {
+	return nil
+}
+
+func (sqlserverDialect) DataSourceWithDatabase(dataSourceName string, databaseName string) (string, error) {
+	return sqlserverDSNWithDatabase(dataSourceName, databaseName)
+}
+
+func (sqlserverDialect) TruncateTable(db *gorm.DB, table string) error {
+	return db.Exec("truncate table " + db.Statement.Quote(table)).Error
+}
+
+// sqliteDialect uses the database file of the data source.
+type sqliteDialect struct {
+	standardDialect
+}
+
+func (sqliteDialect) Open(dataSourceName string) gorm.Dialector {
+	return sqlite.Open(dataSourceName)
+}
+
+func (sqliteDialect) CreateDatabase(*gorm.DB, string) error {
+	return nil
+}
+
+func (sqliteDialect) DataSourceWithDatabase(dataSourceName string, _ string) (string, error) {
+	return dataSourceName, nil
+}
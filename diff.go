@@ -0,0 +1,119 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+
+	"github.com/casbin/casbin/v3/model"
+	"github.com/casbin/casbin/v3/persist"
+)
+
+// PtypeDiff is the difference between two policies for one ptype.
+// The rules are given without their ptype.
+type PtypeDiff struct {
+	Added     [][]string
+	Removed   [][]string
+	Unchanged [][]string
+}
+
+// PolicyDiff is the difference between two policies, by ptype.
+type PolicyDiff map[string]*PtypeDiff
+
+// HasChanges returns whether a rule was added or removed.
+func (d PolicyDiff) HasChanges() bool {
+	for _, pd := range d {
+		if len(pd.Added) > 0 || len(pd.Removed) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (d PolicyDiff) ptype(ptype string) *PtypeDiff {
+	pd, ok := d[ptype]
+	if !ok {
+		pd = &PtypeDiff{}
+		d[ptype] = pd
+	}
+	return pd
+}
+
+// DiffModel returns the difference from the stored policy to the policy of the model,
+// which is what SavePolicy would change.
+func (a *Adapter) DiffModel(ctx context.Context, model model.Model) (PolicyDiff, error) {
+	stored, err := a.findRules(a.db.WithContext(ctx).Order("ID"))
+	if err != nil {
+		return nil, err
+	}
+	return diffPolicies(stored, a.modelLines(model)), nil
+}
+
+// DiffAdapter returns the difference from the policy stored by the adapter to the policy stored by other,
+// which can be any adapter. The policy of other is loaded into a copy of the model, which defines its ptypes.
+func (a *Adapter) DiffAdapter(ctx context.Context, model model.Model, other persist.Adapter) (PolicyDiff, error) {
+	otherModel := model.Copy()
+	otherModel.ClearPolicy()
+	var err error
+	if o, ok := other.(persist.ContextAdapter); ok {
+		err = o.LoadPolicyCtx(ctx, otherModel)
+	} else {
+		err = other.LoadPolicy(otherModel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.DiffModel(ctx, otherModel)
+}
+
+// diffPolicies returns the difference from the rules of from to the rules of to.
+// A rule given twice is counted once.
+func diffPolicies(from []CasbinRule, to []CasbinRule) PolicyDiff {
+	fromKeys := make(map[string]bool, len(from))
+	for _, line := range from {
+		fromKeys[policyKey(line.policyArray())] = true
+	}
+	toKeys := make(map[string]bool, len(to))
+	for _, line := range to {
+		toKeys[policyKey(line.policyArray())] = true
+	}
+
+	d := PolicyDiff{}
+	for _, line := range from {
+		p := line.policyArray()
+		key := policyKey(p)
+		if !fromKeys[key] {
+			continue
+		}
+		fromKeys[key] = false
+		pd := d.ptype(p[0])
+		if toKeys[key] {
+			pd.Unchanged = append(pd.Unchanged, p[1:])
+		} else {
+			pd.Removed = append(pd.Removed, p[1:])
+		}
+	}
+	for _, line := range to {
+		p := line.policyArray()
+		key := policyKey(p)
+		if _, ok := fromKeys[key]; ok || !toKeys[key] {
+			continue
+		}
+		toKeys[key] = false
+		pd := d.ptype(p[0])
+		pd.Added = append(pd.Added, p[1:])
+	}
+	return d
+}
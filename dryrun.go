@@ -0,0 +1,73 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// DryRunReport reports the changes made by the writes of a dry run.
+type DryRunReport struct {
+	// RowsAffected is the number of rules removed plus the number of rules added,
+	// a rule updated by UpdatePolicy or UpdatePolicies counting once.
+	RowsAffected int64
+	// Removed and Added hold the rules removed and added, as ptype followed by their values.
+	// For an update, Removed[i] was updated to Added[i].
+	Removed [][]string
+	Added   [][]string
+}
+
+func (r *DryRunReport) add(op ChangeOp, removed []CasbinRule, added []CasbinRule) {
+	if op == ChangeOpUpdate {
+		r.RowsAffected += int64(len(removed))
+	} else {
+		r.RowsAffected += int64(len(removed) + len(added))
+	}
+	for _, line := range removed {
+		r.Removed = append(r.Removed, line.policyArray())
+	}
+	for _, line := range added {
+		r.Added = append(r.Added, line.policyArray())
+	}
+}
+
+// DryRun calls fc with a copy of the adapter writing within a transaction that is always rolled back,
+// and reports the changes made by its writes, for instance to preview a RemoveFilteredPolicy
+// before running it. The SQL statements run for real, so the database checks apply,
+// and the rows they touch stay locked until the rollback.
+// The change log and the audit trail are written and rolled back too.
+func (a *Adapter) DryRun(ctx context.Context, fc func(a *Adapter) error) (*DryRunReport, error) {
+	report := &DryRunReport{}
+	err := a.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		dry := a.Copy()
+		dry.db = tx
+		dry.dryRun = report
+		if err := fc(dry); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err != errDryRun {
+		return nil, err
+	}
+	return report, nil
+}
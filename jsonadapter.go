@@ -0,0 +1,570 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/casbin/casbin/v3/model"
+	"github.com/casbin/casbin/v3/persist"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const defaultJSONTableName = "casbin_json_rule"
+
+// jsonValueExprs returns, by dialect, the SQL expression of the value at index i
+// of the JSON array stored in column, the quoted rule column.
+// The rules of the other dialects, such as SQLite, are filtered in Go.
+var jsonValueExprs = map[string]func(column string, i int) string{
+	"postgres": func(column string, i int) string {
+		return fmt.Sprintf("(%s::jsonb ->> %d)", column, i)
+	},
+	"mysql": func(column string, i int) string {
+		return fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(%s, '$[%d]'))", column, i)
+	},
+	"sqlserver": func(column string, i int) string {
+		return fmt.Sprintf("JSON_VALUE(%s, '$[%d]')", column, i)
+	},
+}
+
+// JSONRule is a row of the table of a JSONAdapter.
+// Rule holds the values of the rule as a JSON array, and Hash identifies the rule
+// for the unique index, whatever its length.
+type JSONRule struct {
+	ID    uint   `gorm:"primaryKey;autoIncrement"`
+	Ptype string `gorm:"size:100"`
+	Rule  string
+	Hash  string `gorm:"size:64"`
+}
+
+// values returns the values of the rule.
+func (r *JSONRule) values() ([]string, error) {
+	var values []string
+	if err := json.Unmarshal([]byte(r.Rule), &values); err != nil {
+		return nil, errors.Wrapf(err, "invalid rule %d", r.ID)
+	}
+	return values, nil
+}
+
+// JSONAdapter is a Gorm adapter storing each rule as a JSON array in a single column,
+// so rules have no limit on their number of values or on the length of the values.
+// It accepts the filters of type Filter, []Filter and BatchFilter.
+// RemovePolicy, RemovePolicies and UpdatePolicy match the rules exactly.
+type JSONAdapter struct {
+	db         *gorm.DB
+	tableName  string
+	isFiltered bool
+	// jsonValueExpr is the expression of jsonValueExprs for the dialect of db, nil if there is none.
+	jsonValueExpr func(column string, i int) string
+	definitions   atomic.Pointer[map[string]int]
+}
+
+var (
+	_ persist.Adapter                 = (*JSONAdapter)(nil)
+	_ persist.BatchAdapter            = (*JSONAdapter)(nil)
+	_ persist.FilteredAdapter         = (*JSONAdapter)(nil)
+	_ persist.UpdatableAdapter        = (*JSONAdapter)(nil)
+	_ persist.ContextAdapter          = (*JSONAdapter)(nil)
+	_ persist.ContextBatchAdapter     = (*JSONAdapter)(nil)
+	_ persist.ContextFilteredAdapter  = (*JSONAdapter)(nil)
+	_ persist.ContextUpdatableAdapter = (*JSONAdapter)(nil)
+)
+
+// NewJSONAdapterByDB is the constructor for JSONAdapter.
+// tableName is "casbin_json_rule" if empty. The table is created if it doesn't exist,
+// unless auto migrate was turned off with TurnOffAutoMigrate.
+func NewJSONAdapterByDB(db *gorm.DB, tableName string) (*JSONAdapter, error) {
+	if tableName == "" {
+		tableName = defaultJSONTableName
+	}
+	if err := checkIdentifier("table name", tableName, true); err != nil {
+		return nil, err
+	}
+	a := &JSONAdapter{
+		db:            db.Session(&gorm.Session{NewDB: true, Context: db.Statement.Context}),
+		tableName:     tableName,
+		jsonValueExpr: jsonValueExprs[db.Dialector.Name()],
+	}
+
+	if a.db.Statement.Context.Value(disableMigrateKey) == nil {
+		if err := a.table(a.db).AutoMigrate(&JSONRule{}); err != nil {
+			return nil, err
+		}
+		index := indexName(tableName, "hash")
+		if !a.db.Migrator().HasIndex(tableName, index) {
+			if err := a.db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (hash)", a.db.Statement.Quote(index), a.db.Statement.Quote(tableName))).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+	return a, nil
+}
+
+// setDefinitions remembers the number of values each ptype of the model declares.
+func (a *JSONAdapter) setDefinitions(m model.Model) {
+	defs := policyDefinitions(m)
+	a.definitions.Store(&defs)
+}
+
+func (a *JSONAdapter) table(db *gorm.DB) *gorm.DB {
+	return db.Table(a.tableName)
+}
+
+// valueExpr returns the SQL expression of the value at index i of a rule, or nil if the values are filtered in Go.
+func (a *JSONAdapter) valueExpr() func(i int) string {
+	expr := a.jsonValueExpr
+	if expr == nil {
+		return nil
+	}
+	// RULE is a reserved word of T-SQL.
+	column := a.db.Statement.Quote("rule")
+	return func(i int) string {
+		return fmt.Sprintf("COALESCE(%s, '')", expr(column, i))
+	}
+}
+
+// newJSONRule returns the row of a rule.
+func newJSONRule(ptype string, rule []string) (JSONRule, error) {
+	b, err := json.Marshal(rule)
+	if err != nil {
+		return JSONRule{}, err
+	}
+	return JSONRule{Ptype: ptype, Rule: string(b), Hash: jsonRuleHash(ptype, rule)}, nil
+}
+
+// jsonRuleHash returns the hash identifying a rule.
+func jsonRuleHash(ptype string, rule []string) string {
+	sum := sha256.Sum256([]byte(policyKey(append([]string{ptype}, rule...))))
+	return hex.EncodeToString(sum[:])
+}
+
+func newJSONRules(ptype string, rules [][]string) ([]JSONRule, error) {
+	rows := make([]JSONRule, 0, len(rules))
+	for _, rule := range rules {
+		row, err := newJSONRule(ptype, rule)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// findRules returns the rows matching any of the filters, ordered by ID.
+func (a *JSONAdapter) findRules(db *gorm.DB, filters []Filter) ([]JSONRule, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	value := a.valueExpr()
+	var queryStrs []string
+	var queryArgs []interface{}
+	for _, f := range filters {
+		if value == nil {
+			// Only the ptype is filtered in SQL.
+			f = Filter{Ptype: f.Ptype}
+		}
+		str, args := filterWhereOn(f, value)
+		queryStrs = append(queryStrs, "("+str+")")
+		queryArgs = append(queryArgs, args...)
+	}
+
+	var rows []JSONRule
+	if err := a.table(db).Where(strings.Join(queryStrs, " or "), queryArgs...).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if value != nil {
+		return rows, nil
+	}
+
+	matched := rows[:0]
+	for _, row := range rows {
+		values, err := row.values()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range filters {
+			if matchesFilter(f, values) {
+				matched = append(matched, row)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// matchesFilter returns whether the values of a rule match the value filters of f,
+// a missing value being empty.
+func matchesFilter(f Filter, values []string) bool {
+	for i, allowed := range f.values() {
+		if len(allowed) == 0 {
+			continue
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		found := false
+		for _, v := range allowed {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// filteredRulesFilter checks the field index and values of a filtered removal or update,
+// and returns the filter matching the rules. A field index of -1 matches all the rules of ptype.
+// The values must fit the policy definition of ptype in the model last loaded or saved by the adapter.
+func (a *JSONAdapter) filteredRulesFilter(ptype string, fieldIndex int, fieldValues []string) (Filter, error) {
+	if fieldIndex == -1 {
+		return Filter{Ptype: []string{ptype}}, nil
+	}
+	if fieldIndex < 0 {
+		return Filter{}, errors.Errorf("invalid field index %d", fieldIndex)
+	}
+	if err := checkQueryField(fieldValues); err != nil {
+		return Filter{}, err
+	}
+	if defs := a.definitions.Load(); defs != nil {
+		if n, ok := (*defs)[ptype]; ok && fieldIndex+len(fieldValues) > n {
+			return Filter{}, errors.Errorf("field index %d with %d values exceeds the %d values of ptype %s", fieldIndex, len(fieldValues), n, ptype)
+		}
+	}
+	return fieldFilter(ptype, fieldIndex, fieldValues...), nil
+}
+
+// fieldFilter returns the filter matching the rules of ptype whose values from index fieldIndex
+// are fieldValues, an empty value matching any value.
+func fieldFilter(ptype string, fieldIndex int, fieldValues ...string) Filter {
+	f := Filter{Ptype: []string{ptype}}
+	for i, v := range fieldValues {
+		if v == "" {
+			continue
+		}
+		switch index := fieldIndex + i; index {
+		case 0:
+			f.V0 = []string{v}
+		case 1:
+			f.V1 = []string{v}
+		case 2:
+			f.V2 = []string{v}
+		case 3:
+			f.V3 = []string{v}
+		case 4:
+			f.V4 = []string{v}
+		case 5:
+			f.V5 = []string{v}
+		default:
+			for len(f.ExtraV) <= index-6 {
+				f.ExtraV = append(f.ExtraV, nil)
+			}
+			f.ExtraV[index-6] = []string{v}
+		}
+	}
+	return f
+}
+
+// deleteRules deletes the rows by ID within tx.
+func (a *JSONAdapter) deleteRules(tx *gorm.DB, rows []JSONRule) error {
+	chunkSize := 1000
+	for i := 0; i < len(rows); i += chunkSize {
+		chunk := rows[i:min(i+chunkSize, len(rows))]
+		ids := make([]uint, len(chunk))
+		for j, row := range chunk {
+			ids[j] = row.ID
+		}
+		if err := a.table(tx).Where("id IN ?", ids).Delete(&JSONRule{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadJSONRules(rows []JSONRule, model model.Model) error {
+	for _, row := range rows {
+		values, err := row.values()
+		if err != nil {
+			return err
+		}
+		if err := persist.LoadPolicyArray(append([]string{row.Ptype}, values...), model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPolicy loads policy from database.
+func (a *JSONAdapter) LoadPolicy(model model.Model) error {
+	return a.LoadPolicyCtx(context.Background(), model)
+}
+
+// LoadPolicyCtx loads policy from database.
+func (a *JSONAdapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
+	a.setDefinitions(model)
+	var rows []JSONRule
+	if err := a.table(a.db.WithContext(ctx)).Order("id").Find(&rows).Error; err != nil {
+		return err
+	}
+	return loadJSONRules(rows, model)
+}
+
+// LoadFilteredPolicy loads only policy rules that match the filter.
+func (a *JSONAdapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
+	return a.LoadFilteredPolicyCtx(context.Background(), model, filter)
+}
+
+// LoadFilteredPolicyCtx loads only policy rules that match the filter.
+func (a *JSONAdapter) LoadFilteredPolicyCtx(ctx context.Context, model model.Model, filter interface{}) error {
+	a.setDefinitions(model)
+	var filters []Filter
+	switch filterValue := filter.(type) {
+	case Filter:
+		filters = []Filter{filterValue}
+	case *Filter:
+		filters = []Filter{*filterValue}
+	case []Filter:
+		filters = filterValue
+	case BatchFilter:
+		filters = filterValue.filters
+	case *BatchFilter:
+		filters = filterValue.filters
+	default:
+		return errors.New("unsupported filter type")
+	}
+
+	rows, err := a.findRules(a.db.WithContext(ctx), filters)
+	if err != nil {
+		return err
+	}
+	if err := loadJSONRules(rows, model); err != nil {
+		return err
+	}
+	a.isFiltered = true
+	return nil
+}
+
+// IsFiltered returns true if the loaded policy has been filtered.
+func (a *JSONAdapter) IsFiltered() bool {
+	return a.isFiltered
+}
+
+// IsFilteredCtx returns true if the loaded policy has been filtered.
+func (a *JSONAdapter) IsFilteredCtx(ctx context.Context) bool {
+	return a.isFiltered
+}
+
+// SavePolicy saves policy to database.
+func (a *JSONAdapter) SavePolicy(model model.Model) error {
+	return a.SavePolicyCtx(context.Background(), model)
+}
+
+// SavePolicyCtx saves policy to database.
+func (a *JSONAdapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
+	a.setDefinitions(model)
+	var rows []JSONRule
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			secRows, err := newJSONRules(ptype, ast.Policy)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, secRows...)
+		}
+	}
+
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := a.table(tx).Where("1 = 1").Delete(&JSONRule{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return a.table(tx).Clauses(dialectOf(tx, "").IgnoreConflict()).CreateInBatches(rows, 1000).Error
+	})
+}
+
+// AddPolicy adds a policy rule to the storage.
+func (a *JSONAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return a.AddPoliciesCtx(context.Background(), sec, ptype, [][]string{rule})
+}
+
+// AddPolicyCtx adds a policy rule to the storage.
+func (a *JSONAdapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
+	return a.AddPoliciesCtx(ctx, sec, ptype, [][]string{rule})
+}
+
+// AddPolicies adds multiple policy rules to the storage.
+func (a *JSONAdapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	return a.AddPoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// AddPoliciesCtx adds multiple policy rules to the storage.
+func (a *JSONAdapter) AddPoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	rows, err := newJSONRules(ptype, rules)
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	return a.table(a.db.WithContext(ctx)).Clauses(dialectOf(a.db, "").IgnoreConflict()).Create(&rows).Error
+}
+
+// RemovePolicy removes a policy rule from the storage.
+func (a *JSONAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return a.RemovePoliciesCtx(context.Background(), sec, ptype, [][]string{rule})
+}
+
+// RemovePolicyCtx removes a policy rule from the storage.
+func (a *JSONAdapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
+	return a.RemovePoliciesCtx(ctx, sec, ptype, [][]string{rule})
+}
+
+// RemovePolicies removes multiple policy rules from the storage.
+func (a *JSONAdapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	return a.RemovePoliciesCtx(context.Background(), sec, ptype, rules)
+}
+
+// RemovePoliciesCtx removes multiple policy rules from the storage.
+func (a *JSONAdapter) RemovePoliciesCtx(ctx context.Context, sec string, ptype string, rules [][]string) error {
+	hashes := make([]string, len(rules))
+	for i, rule := range rules {
+		hashes[i] = jsonRuleHash(ptype, rule)
+	}
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		chunkSize := 1000
+		for i := 0; i < len(hashes); i += chunkSize {
+			chunk := hashes[i:min(i+chunkSize, len(hashes))]
+			if err := a.table(tx).Where("hash IN ?", chunk).Delete(&JSONRule{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
+func (a *JSONAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return a.RemoveFilteredPolicyCtx(context.Background(), sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyCtx removes policy rules that match the filter from the storage.
+func (a *JSONAdapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	filter, err := a.filteredRulesFilter(ptype, fieldIndex, fieldValues)
+	if err != nil {
+		return err
+	}
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		rows, err := a.findRules(tx, []Filter{filter})
+		if err != nil {
+			return err
+		}
+		return a.deleteRules(tx, rows)
+	})
+}
+
+// UpdatePolicy updates a new policy rule to DB.
+func (a *JSONAdapter) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return a.UpdatePoliciesCtx(context.Background(), sec, ptype, [][]string{oldRule}, [][]string{newRule})
+}
+
+// UpdatePolicyCtx updates a new policy rule to DB.
+func (a *JSONAdapter) UpdatePolicyCtx(ctx context.Context, sec string, ptype string, oldRule, newRule []string) error {
+	return a.UpdatePoliciesCtx(ctx, sec, ptype, [][]string{oldRule}, [][]string{newRule})
+}
+
+// UpdatePolicies updates some policy rules to DB.
+func (a *JSONAdapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return a.UpdatePoliciesCtx(context.Background(), sec, ptype, oldRules, newRules)
+}
+
+// UpdatePoliciesCtx updates some policy rules to DB.
+func (a *JSONAdapter) UpdatePoliciesCtx(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	if len(oldRules) != len(newRules) {
+		return errors.New("the numbers of old and new rules differ")
+	}
+	newRows, err := newJSONRules(ptype, newRules)
+	if err != nil {
+		return err
+	}
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, oldRule := range oldRules {
+			err := a.table(tx).Where("hash = ?", jsonRuleHash(ptype, oldRule)).
+				Updates(map[string]interface{}{"rule": newRows[i].Rule, "hash": newRows[i].Hash}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateFilteredPolicies deletes old rules and adds new rules.
+func (a *JSONAdapter) UpdateFilteredPolicies(sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	return a.UpdateFilteredPoliciesCtx(context.Background(), sec, ptype, newRules, fieldIndex, fieldValues...)
+}
+
+// UpdateFilteredPoliciesCtx deletes old rules and adds new rules.
+func (a *JSONAdapter) UpdateFilteredPoliciesCtx(ctx context.Context, sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	filter, err := a.filteredRulesFilter(ptype, fieldIndex, fieldValues)
+	if err != nil {
+		return nil, err
+	}
+	newRows, err := newJSONRules(ptype, newRules)
+	if err != nil {
+		return nil, err
+	}
+
+	oldRules := make([][]string, 0)
+	err = a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		rows, err := a.findRules(tx, []Filter{filter})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			values, err := row.values()
+			if err != nil {
+				return err
+			}
+			oldRules = append(oldRules, values)
+		}
+		if err := a.deleteRules(tx, rows); err != nil {
+			return err
+		}
+		if len(newRows) == 0 {
+			return nil
+		}
+		return a.table(tx).Clauses(dialectOf(tx, "").IgnoreConflict()).Create(&newRows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oldRules, nil
+}
+
+// GetDb returns the database of the adapter.
+func (a *JSONAdapter) GetDb() *gorm.DB {
+	return a.db
+}
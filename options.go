@@ -0,0 +1,324 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Option configures the adapter created by New.
+type Option func(*options) error
+
+type options struct {
+	driverName     string
+	dataSourceName string
+	databaseName   string
+	db             *gorm.DB
+	dbPool         *DbPool
+	dbName         string
+	schema         string
+	tablePrefix    string
+	tableName      string
+	customTable    interface{}
+	fieldCount     int
+	columnSizes    ColumnSizes
+	autoMigrate    bool
+	filtered       bool
+	logger         logger.Interface
+	loadBatchSize  int
+}
+
+// WithDriver makes New open the database of the data source with the driver,
+// one of postgres, mysql, sqlserver, sqlite3 and the dialects registered with RegisterDialect.
+// The data source is used as is, unless WithDatabaseName is given.
+func WithDriver(driverName string, dataSourceName string) Option {
+	return func(o *options) error {
+		if _, err := lookupDialect(driverName); err != nil {
+			return err
+		}
+		if dataSourceName == "" {
+			return errors.New("the data source name must not be empty")
+		}
+		o.driverName = driverName
+		o.dataSourceName = dataSourceName
+		return nil
+	}
+}
+
+// WithDatabaseName makes New create the database if it doesn't exist and connect to it.
+// It requires WithDriver, whose data source must not specify a database.
+func WithDatabaseName(name string) Option {
+	return func(o *options) error {
+		if err := checkIdentifier("database name", name, false); err != nil {
+			return err
+		}
+		o.databaseName = name
+		return nil
+	}
+}
+
+// WithDB makes New use an existing Gorm instance.
+func WithDB(db *gorm.DB) Option {
+	return func(o *options) error {
+		if db == nil {
+			return errors.New("the Gorm instance must not be nil")
+		}
+		o.db = db
+		return nil
+	}
+}
+
+// WithDbPool makes New use the database dbName of a pool created by InitDbResolver.
+func WithDbPool(dbPool DbPool, dbName string) Option {
+	return func(o *options) error {
+		if dbPool.source == nil {
+			return errors.New("the db pool is not initialized, use InitDbResolver")
+		}
+		if _, ok := dbPool.dbMap[dbName]; !ok {
+			return errors.Errorf("database %q is not in the db pool", dbName)
+		}
+		o.dbPool = &dbPool
+		o.dbName = dbName
+		return nil
+	}
+}
+
+// WithTableName sets the name of the policy table, "casbin_rule" by default.
+// It may be qualified by a schema, as in "authz.casbin_rule".
+func WithTableName(name string) Option {
+	return func(o *options) error {
+		if err := checkIdentifier("table name", name, true); err != nil {
+			return err
+		}
+		o.tableName = name
+		return nil
+	}
+}
+
+// WithSchema makes the adapter keep its tables in the Postgres schema, created if it doesn't exist.
+// The table name must not be qualified by another schema.
+func WithSchema(schema string) Option {
+	return func(o *options) error {
+		if err := checkIdentifier("schema", schema, false); err != nil {
+			return err
+		}
+		o.schema = schema
+		return nil
+	}
+}
+
+// WithTablePrefix sets the prefix of the policy table name, joined to it by an underscore.
+func WithTablePrefix(prefix string) Option {
+	return func(o *options) error {
+		if prefix != "" {
+			if err := checkIdentifier("table prefix", prefix, false); err != nil {
+				return err
+			}
+		}
+		o.tablePrefix = prefix
+		return nil
+	}
+}
+
+// WithCustomTable makes the adapter store the rules in rows of the struct type of t,
+// which has a Ptype field and value fields V0, V1 and so on, as with NewAdapterByDBWithCustomTable.
+func WithCustomTable(t interface{}) Option {
+	return func(o *options) error {
+		if t == nil || reflect.Indirect(reflect.ValueOf(t)).Kind() != reflect.Struct {
+			return errors.Errorf("the custom table must be a struct, got %T", t)
+		}
+		rt := reflect.Indirect(reflect.ValueOf(t)).Type()
+		if _, ok := rt.FieldByName("Ptype"); !ok {
+			return errors.Errorf("the custom table %s has no Ptype field", rt)
+		}
+		if countValueFields(t) == 0 {
+			return errors.Errorf("the custom table %s has no V0 field", rt)
+		}
+		o.customTable = t
+		return nil
+	}
+}
+
+// WithFieldCount sets the number of value columns of the table, six by default.
+func WithFieldCount(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return errors.Errorf("the field count must be greater than 0, got %d", n)
+		}
+		o.fieldCount = n
+		return nil
+	}
+}
+
+// WithColumnSizes sets the sizes of the columns of the table, see NewAdapterByDBWithColumnSizes.
+func WithColumnSizes(sizes ColumnSizes) Option {
+	return func(o *options) error {
+		if sizes.Ptype < 0 || sizes.Value < 0 {
+			return errors.Errorf("column sizes must not be negative, got %+v", sizes)
+		}
+		o.columnSizes = sizes
+		return nil
+	}
+}
+
+// WithAutoMigrate sets whether New and the Enable methods create and migrate the tables, true by default.
+func WithAutoMigrate(enable bool) Option {
+	return func(o *options) error {
+		o.autoMigrate = enable
+		return nil
+	}
+}
+
+// WithFiltered makes the adapter a filtered adapter,
+// for which Casbin doesn't call LoadPolicy automatically.
+func WithFiltered(enable bool) Option {
+	return func(o *options) error {
+		o.filtered = enable
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the queries of the adapter.
+func WithLogger(l logger.Interface) Option {
+	return func(o *options) error {
+		if l == nil {
+			return errors.New("the logger must not be nil")
+		}
+		o.logger = l
+		return nil
+	}
+}
+
+// WithLoadBatchSize makes LoadPolicy read the table in batches, see SetLoadBatchSize.
+func WithLoadBatchSize(size int) Option {
+	return func(o *options) error {
+		if size < 0 {
+			return errors.Errorf("the load batch size must not be negative, got %d", size)
+		}
+		o.loadBatchSize = size
+		return nil
+	}
+}
+
+// New creates an adapter configured by the options, which are all checked before connecting.
+// Exactly one of WithDriver, WithDB and WithDbPool must be given.
+// Example: gormadapter.New(gormadapter.WithDB(db), gormadapter.WithTableName("casbin"), gormadapter.WithFiltered(true))
+func New(opts ...Option) (*Adapter, error) {
+	o := &options{tableName: defaultTableName, autoMigrate: true}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+
+	db, err := o.open()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !o.autoMigrate {
+		ctx = context.WithValue(ctx, disableMigrateKey, false)
+	}
+	fieldCount := o.fieldCount
+	if o.customTable != nil {
+		ctx = context.WithValue(ctx, customTableKey, o.customTable)
+		fieldCount = countValueFields(o.customTable)
+	}
+	db = db.WithContext(ctx)
+	if o.logger != nil {
+		db = db.Session(&gorm.Session{Logger: o.logger})
+	}
+
+	a, err := newAdapterByDB(db, o.schema, o.tablePrefix, o.tableName, fieldCount, o.columnSizes)
+	if err != nil {
+		if o.driverName != "" {
+			if sqlDB, e := db.DB(); e == nil {
+				_ = sqlDB.Close()
+			}
+		}
+		return nil, err
+	}
+	a.isFiltered = o.filtered
+	a.loadBatchSize = o.loadBatchSize
+	if o.driverName != "" {
+		a.driverName = o.driverName
+		a.dataSourceName = o.dataSourceName
+		a.databaseName = o.databaseName
+		a.dbSpecified = o.databaseName == ""
+		// Call the destructor when the object is released.
+		runtime.SetFinalizer(a, finalizer)
+	}
+	return a, nil
+}
+
+// check checks that the options are consistent.
+func (o *options) check() error {
+	sources := 0
+	for _, set := range []bool{o.driverName != "", o.db != nil, o.dbPool != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of WithDriver, WithDB and WithDbPool must be given")
+	}
+	if o.databaseName != "" {
+		if o.driverName == "" {
+			return errors.New("WithDatabaseName requires WithDriver")
+		}
+		if o.driverName == "sqlite3" {
+			return errors.New("WithDatabaseName is not supported by sqlite3, the data source names the database file")
+		}
+	}
+	if o.schema != "" && strings.Contains(o.tableName, ".") {
+		return errors.Errorf("table name %q is qualified by a schema, but the schema %q is set", o.tableName, o.schema)
+	}
+	if o.customTable != nil && (o.fieldCount != 0 || o.columnSizes != (ColumnSizes{})) {
+		return errors.New("the field count and column sizes of a custom table are defined by its struct")
+	}
+	return nil
+}
+
+// open returns the Gorm instance the adapter uses.
+func (o *options) open() (*gorm.DB, error) {
+	switch {
+	case o.db != nil:
+		return o.db, nil
+	case o.dbPool != nil:
+		return o.dbPool.switchDb(o.dbName), nil
+	}
+
+	a := &Adapter{
+		driverName:     o.driverName,
+		dataSourceName: o.dataSourceName,
+		databaseName:   o.databaseName,
+		dbSpecified:    o.databaseName == "",
+	}
+	return a.openDB()
+}
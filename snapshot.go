@@ -0,0 +1,226 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+// Snapshot is a named copy of the whole policy taken at a point in time.
+type Snapshot struct {
+	Name      string `gorm:"primaryKey;size:255"`
+	RuleCount int
+	CreatedAt time.Time
+}
+
+// snapshotRuleRow is a rule of a snapshot, stored as ptype followed by its values in JSON.
+type snapshotRuleRow struct {
+	Snapshot string `gorm:"primaryKey;size:255"`
+	Seq      int    `gorm:"primaryKey;autoIncrement:false"`
+	Rule     string
+}
+
+// EnableSnapshots enables taking snapshots of the policy and rolling back to them.
+// The snapshots are stored in tables named after the policy table with the
+// "_snapshots" and "_snapshot_rules" suffixes.
+func (a *Adapter) EnableSnapshots(enable bool) error {
+	if !enable {
+		a.snapshotTable = ""
+		return nil
+	}
+
+	table := a.getFullTableName() + "_snapshots"
+	if a.db.Statement.Context.Value(disableMigrateKey) == nil {
+		db := a.db.Session(&gorm.Session{NewDB: true})
+		if err := db.Table(table).AutoMigrate(&Snapshot{}); err != nil {
+			return err
+		}
+		if err := db.Table(a.getFullTableName() + "_snapshot_rules").AutoMigrate(&snapshotRuleRow{}); err != nil {
+			return err
+		}
+	}
+	a.snapshotTable = table
+	return nil
+}
+
+// snapshotDB returns a session on the database of the adapter without the policy table scope.
+func (a *Adapter) snapshotDB(db *gorm.DB) (*gorm.DB, error) {
+	if a.snapshotTable == "" {
+		return nil, errors.New("snapshots are not enabled")
+	}
+	return db.Session(&gorm.Session{NewDB: true}), nil
+}
+
+func (a *Adapter) snapshotRuleTable() string {
+	return a.getFullTableName() + "_snapshot_rules"
+}
+
+// CreateSnapshot copies the stored policy to a new snapshot named name.
+func (a *Adapter) CreateSnapshot(ctx context.Context, name string) (Snapshot, error) {
+	if name == "" {
+		return Snapshot{}, errors.New("the snapshot name is empty")
+	}
+
+	var snapshot Snapshot
+	err := a.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		db, err := a.snapshotDB(tx)
+		if err != nil {
+			return err
+		}
+		var count int64
+		if err := db.Table(a.snapshotTable).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.Errorf("snapshot %q already exists", name)
+		}
+
+		lines, err := a.findRules(tx.Order("ID"))
+		if err != nil {
+			return err
+		}
+		rows := make([]snapshotRuleRow, len(lines))
+		for i, line := range lines {
+			b, err := json.Marshal(line.policyArray())
+			if err != nil {
+				return err
+			}
+			rows[i] = snapshotRuleRow{Snapshot: name, Seq: i, Rule: string(b)}
+		}
+
+		snapshot = Snapshot{Name: name, RuleCount: len(rows), CreatedAt: time.Now()}
+		if err := db.Table(a.snapshotTable).Create(&snapshot).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return db.Table(a.snapshotRuleTable()).CreateInBatches(rows, 1000).Error
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// Snapshots returns the snapshots, oldest first.
+func (a *Adapter) Snapshots(ctx context.Context) ([]Snapshot, error) {
+	db, err := a.snapshotDB(a.db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	err = db.Table(a.snapshotTable).Order("created_at").Order("name").Find(&snapshots).Error
+	return snapshots, err
+}
+
+// SnapshotPolicy returns the rules of the snapshot named name, as ptype followed by their values.
+func (a *Adapter) SnapshotPolicy(ctx context.Context, name string) ([][]string, error) {
+	lines, err := a.snapshotLines(a.db.WithContext(ctx), name)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([][]string, len(lines))
+	for i, line := range lines {
+		rules[i] = line.policyArray()
+	}
+	return rules, nil
+}
+
+// snapshotLines reads the rules of the snapshot named name.
+func (a *Adapter) snapshotLines(db *gorm.DB, name string) ([]CasbinRule, error) {
+	db, err := a.snapshotDB(db)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := db.Table(a.snapshotTable).Where("name = ?", name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errors.Errorf("snapshot %q doesn't exist", name)
+	}
+
+	var rows []snapshotRuleRow
+	if err := db.Table(a.snapshotRuleTable()).Where("snapshot = ?", name).Order("seq").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	lines := make([]CasbinRule, len(rows))
+	for i, row := range rows {
+		var p []string
+		if err := json.Unmarshal([]byte(row.Rule), &p); err != nil || len(p) == 0 {
+			return nil, errors.Errorf("invalid rule %d of snapshot %q", row.Seq, name)
+		}
+		lines[i] = a.savePolicyLine(p[0], p[1:])
+	}
+	return lines, nil
+}
+
+// DiffSnapshots returns the difference from the snapshot named from to the snapshot named to.
+func (a *Adapter) DiffSnapshots(ctx context.Context, from string, to string) (PolicyDiff, error) {
+	db := a.db.WithContext(ctx)
+	fromLines, err := a.snapshotLines(db, from)
+	if err != nil {
+		return nil, err
+	}
+	toLines, err := a.snapshotLines(db, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffPolicies(fromLines, toLines), nil
+}
+
+// RollbackToSnapshot makes the stored policy the one of the snapshot named name, in one transaction.
+// Like SavePolicyDiff, it only writes the differences, and returns the number of rules added and removed.
+// The enforcers using the policy have to reload it.
+func (a *Adapter) RollbackToSnapshot(ctx context.Context, name string) (added int, removed int, err error) {
+	err = a.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		lines, err := a.snapshotLines(tx, name)
+		if err != nil {
+			return err
+		}
+		added, removed, err = a.replaceRules(tx, ChangeOpRollback, lines)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, removed, nil
+}
+
+// DeleteSnapshot deletes the snapshot named name.
+func (a *Adapter) DeleteSnapshot(ctx context.Context, name string) error {
+	return a.db.WithContext(ctx).Clauses(dbresolver.Write).Transaction(func(tx *gorm.DB) error {
+		db, err := a.snapshotDB(tx)
+		if err != nil {
+			return err
+		}
+		result := db.Table(a.snapshotTable).Where("name = ?", name).Delete(&Snapshot{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.Errorf("snapshot %q doesn't exist", name)
+		}
+		return db.Table(a.snapshotRuleTable()).Where("snapshot = ?", name).Delete(&snapshotRuleRow{}).Error
+	})
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// DeletedRule is a rule deleted in soft delete mode.
+type DeletedRule struct {
+	Ptype     string
+	Rule      []string
+	DeletedAt time.Time
+}
+
+// EnableSoftDelete makes the adapter mark the rules it removes as deleted in a deleted_at column
+// instead of deleting the rows, which is added to the table if missing.
+// The deleted rules are skipped when loading the policy, and restored when they are added again.
+// A custom table needs a DeletedAt field of type gorm.DeletedAt.
+func (a *Adapter) EnableSoftDelete(enable bool) error {
+	if !enable {
+		a.softDelete = false
+		return nil
+	}
+
+	if t := a.db.Statement.Context.Value(customTableKey); t != nil {
+		if layoutOf(reflect.Indirect(reflect.ValueOf(t)).Type()).deletedAt == nil {
+			return errors.New("soft delete needs a DeletedAt field of type gorm.DeletedAt in the custom table")
+		}
+	}
+
+	a.softDelete = true
+	if a.db.Statement.Context.Value(disableMigrateKey) == nil {
+		if err := a.db.AutoMigrate(a.getTableInstance()); err != nil {
+			a.softDelete = false
+			return err
+		}
+		if err := createIndex(a.db.Session(&gorm.Session{NewDB: true}), a.getFullTableName(), "deleted_at"); err != nil {
+			a.softDelete = false
+			return err
+		}
+	}
+	return nil
+}
+
+// deletedRows scopes db to the deleted rows matched by the filter.
+// A nil filter matches every deleted row.
+func (a *Adapter) deletedRows(db *gorm.DB, filter interface{}) (*gorm.DB, error) {
+	if !a.softDelete {
+		return nil, errors.New("soft delete is not enabled")
+	}
+
+	db = db.Unscoped().Where("deleted_at is not null")
+	if filter != nil {
+		queryStr, queryArgs, err := filterCondition(filter)
+		if err != nil {
+			return nil, err
+		}
+		if queryStr == "" {
+			return nil, errors.New("the filter list is empty")
+		}
+		db = db.Where(queryStr, queryArgs...)
+	}
+	return db, nil
+}
+
+// DeletedPolicies returns the deleted rules matched by the filter, which takes the same values as
+// LoadFilteredPolicy. A nil filter matches every deleted rule.
+func (a *Adapter) DeletedPolicies(ctx context.Context, filter interface{}) ([]DeletedRule, error) {
+	db, err := a.deletedRows(a.db.WithContext(ctx), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	t := a.getTableType()
+	rows := reflect.New(reflect.SliceOf(t))
+	if err := db.Order("ID").Find(rows.Interface()).Error; err != nil {
+		return nil, err
+	}
+
+	l := layoutOf(t)
+	deleted := make([]DeletedRule, rows.Elem().Len())
+	for i := range deleted {
+		row := rows.Elem().Index(i)
+		line := l.toLine(row)
+		p := line.policyArray()
+		deleted[i] = DeletedRule{
+			Ptype:     p[0],
+			Rule:      p[1:],
+			DeletedAt: row.FieldByIndex(l.deletedAt).Interface().(gorm.DeletedAt).Time,
+		}
+	}
+	return deleted, nil
+}
+
+// RestorePolicies restores the deleted rules matched by the filter, which takes the same values as
+// LoadFilteredPolicy, and returns the number of rules restored.
+func (a *Adapter) RestorePolicies(ctx context.Context, filter interface{}) (int64, error) {
+	if filter == nil {
+		return 0, errors.New("a filter is required to restore rules")
+	}
+
+	var restored int64
+	err := a.writeTx(ctx, func(tx *gorm.DB) error {
+		db, err := a.deletedRows(tx, filter)
+		if err != nil {
+			return err
+		}
+
+		var lines []CasbinRule
+		if a.tracksChanges() {
+			if lines, err = a.findRules(db.Session(&gorm.Session{})); err != nil {
+				return err
+			}
+		}
+		result := db.Model(a.getTableInstance()).Update("deleted_at", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		restored = result.RowsAffected
+		return a.recordChange(tx, ChangeOpRestore, nil, lines)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
+
+// PurgeDeletedPolicies deletes for good the rules deleted more than retention ago,
+// and returns the number of rules purged.
+func (a *Adapter) PurgeDeletedPolicies(ctx context.Context, retention time.Duration) (int64, error) {
+	if !a.softDelete {
+		return 0, errors.New("soft delete is not enabled")
+	}
+
+	result := a.db.WithContext(ctx).Unscoped().Where("deleted_at < ?", time.Now().Add(-retention)).Delete(a.getTableInstance())
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,351 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gormadapter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v3"
+	"github.com/casbin/casbin/v3/model"
+	"github.com/casbin/casbin/v3/persist"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultWatcherTableName = "casbin_watcher"
+	defaultWatcherInterval  = time.Second
+	defaultWatcherRetention = 10 * time.Minute
+)
+
+// WatcherOptions configures a Watcher. The zero value uses the defaults.
+type WatcherOptions struct {
+	// TableName is the name of the notification table, "casbin_watcher" by default.
+	// It may be qualified by a schema, as in "authz.casbin_watcher".
+	TableName string
+	// Interval is the time between two polls of the notification table, one second by default.
+	Interval time.Duration
+	// Retention is how long the messages are kept in the notification table, ten minutes by default.
+	// A watcher that didn't poll the messages in time asks its callback to reload the whole policy.
+	Retention time.Duration
+}
+
+// WatcherMessage is the message a Watcher publishes for a policy change.
+// Op is empty for Update, which asks the other instances to reload the whole policy.
+type WatcherMessage struct {
+	Op          ChangeOp   `json:"op,omitempty"`
+	Origin      string     `json:"origin"`
+	Sec         string     `json:"sec,omitempty"`
+	Ptype       string     `json:"ptype,omitempty"`
+	Rules       [][]string `json:"rules,omitempty"`
+	NewRules    [][]string `json:"newRules,omitempty"`
+	FieldIndex  int        `json:"fieldIndex,omitempty"`
+	FieldValues []string   `json:"fieldValues,omitempty"`
+}
+
+// watcherRow is a row of the notification table.
+type watcherRow struct {
+	Seq       uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Origin    string `gorm:"size:32"`
+	Message   string
+	CreatedAt time.Time
+}
+
+// Watcher is a persist.Watcher that uses the database shared by the enforcers.
+// It publishes the policy changes in a notification table, and polls the table
+// to call the update callback with the messages published by the other watchers.
+type Watcher struct {
+	db        *gorm.DB
+	tableName string
+	interval  time.Duration
+	retention time.Duration
+	id        string
+
+	mu       sync.Mutex
+	callback func(string)
+	lastSeq  uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+var (
+	_ persist.Watcher          = (*Watcher)(nil)
+	_ persist.WatcherEx        = (*Watcher)(nil)
+	_ persist.UpdatableWatcher = (*Watcher)(nil)
+)
+
+// NewWatcher is the constructor for Watcher. db can be the one of the adapter, see Adapter.GetDb.
+// The notification table is created if it doesn't exist, and only the messages
+// published after the watcher is created are passed to its callback.
+func NewWatcher(db *gorm.DB, opts WatcherOptions) (*Watcher, error) {
+	w := &Watcher{
+		db:        db.Session(&gorm.Session{NewDB: true}),
+		tableName: opts.TableName,
+		interval:  opts.Interval,
+		retention: opts.Retention,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if w.tableName == "" {
+		w.tableName = defaultWatcherTableName
+	}
+	if err := checkIdentifier("table name", w.tableName, true); err != nil {
+		return nil, err
+	}
+	if w.interval <= 0 {
+		w.interval = defaultWatcherInterval
+	}
+	if w.retention <= 0 {
+		w.retention = defaultWatcherRetention
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	w.id = hex.EncodeToString(id)
+
+	if w.db.Statement.Context.Value(disableMigrateKey) == nil {
+		if err := w.db.Table(w.tableName).AutoMigrate(&watcherRow{}); err != nil {
+			return nil, err
+		}
+		if err := createIndex(w.db, w.tableName, "created_at"); err != nil {
+			return nil, err
+		}
+		if err := createSeqTable(w.db, w.tableName); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if w.lastSeq, err = lastSeq(w.db, w.tableName); err != nil {
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// SetUpdateCallback sets the function called with the messages published by the other watchers.
+// See DefaultUpdateCallback for a callback applying the changes incrementally.
+func (w *Watcher) SetUpdateCallback(callback func(string)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.callback = callback
+	return nil
+}
+
+// Update asks the other instances to reload the whole policy.
+func (w *Watcher) Update() error {
+	return w.publish(WatcherMessage{})
+}
+
+// UpdateForAddPolicy publishes a rule added by Enforcer.AddPolicy.
+func (w *Watcher) UpdateForAddPolicy(sec, ptype string, params ...string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpAdd, Sec: sec, Ptype: ptype, Rules: [][]string{params}})
+}
+
+// UpdateForRemovePolicy publishes a rule removed by Enforcer.RemovePolicy.
+func (w *Watcher) UpdateForRemovePolicy(sec, ptype string, params ...string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpRemove, Sec: sec, Ptype: ptype, Rules: [][]string{params}})
+}
+
+// UpdateForRemoveFilteredPolicy publishes the filter of Enforcer.RemoveFilteredPolicy.
+func (w *Watcher) UpdateForRemoveFilteredPolicy(sec, ptype string, fieldIndex int, fieldValues ...string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpRemoveFiltered, Sec: sec, Ptype: ptype, FieldIndex: fieldIndex, FieldValues: fieldValues})
+}
+
+// UpdateForSavePolicy asks the other instances to reload the whole policy after Enforcer.SavePolicy.
+func (w *Watcher) UpdateForSavePolicy(model model.Model) error {
+	return w.publish(WatcherMessage{Op: ChangeOpSave})
+}
+
+// UpdateForAddPolicies publishes the rules added by Enforcer.AddPolicies.
+func (w *Watcher) UpdateForAddPolicies(sec string, ptype string, rules ...[]string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpAdd, Sec: sec, Ptype: ptype, Rules: rules})
+}
+
+// UpdateForRemovePolicies publishes the rules removed by Enforcer.RemovePolicies.
+func (w *Watcher) UpdateForRemovePolicies(sec string, ptype string, rules ...[]string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpRemove, Sec: sec, Ptype: ptype, Rules: rules})
+}
+
+// UpdateForUpdatePolicy publishes a rule updated by Enforcer.UpdatePolicy.
+func (w *Watcher) UpdateForUpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpUpdate, Sec: sec, Ptype: ptype, Rules: [][]string{oldRule}, NewRules: [][]string{newRule}})
+}
+
+// UpdateForUpdatePolicies publishes the rules updated by Enforcer.UpdatePolicies.
+func (w *Watcher) UpdateForUpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	return w.publish(WatcherMessage{Op: ChangeOpUpdate, Sec: sec, Ptype: ptype, Rules: oldRules, NewRules: newRules})
+}
+
+// Close stops polling the notification table, the callback will not be called any more.
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		<-w.stopped
+	})
+}
+
+// publish writes the message to the notification table, and deletes the expired messages.
+func (w *Watcher) publish(msg WatcherMessage) error {
+	msg.Origin = w.id
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return w.db.Transaction(func(tx *gorm.DB) error {
+		seq, err := nextSeq(tx, w.tableName)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		row := watcherRow{Seq: seq, Origin: w.id, Message: string(b), CreatedAt: now}
+		if err := tx.Table(w.tableName).Create(&row).Error; err != nil {
+			return err
+		}
+		return tx.Table(w.tableName).Where("created_at < ?", now.Add(-w.retention)).Delete(&watcherRow{}).Error
+	})
+}
+
+func (w *Watcher) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.poll(); err != nil {
+				w.db.Logger.Error(context.Background(), "failed to poll the casbin watcher table: %v", err)
+			}
+		}
+	}
+}
+
+// poll calls the callback with the messages published by the other watchers since the last poll.
+// If some of them were deleted before being polled, because the watcher was stopped or polled
+// less often than the retention, it calls the callback with an Update message instead,
+// the sequence numbers of the messages having no gaps otherwise.
+func (w *Watcher) poll() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The messages up to the last sequence number are committed, as it is incremented in their transaction.
+	last, err := lastSeq(w.db, w.tableName)
+	if err != nil || last <= w.lastSeq {
+		return err
+	}
+	var rows []watcherRow
+	if err := w.db.Table(w.tableName).Where("seq > ? AND seq <= ?", w.lastSeq, last).Order("seq").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	if len(rows) == 0 || rows[0].Seq != w.lastSeq+1 {
+		w.lastSeq = last
+		if w.callback != nil {
+			b, err := json.Marshal(WatcherMessage{})
+			if err != nil {
+				return err
+			}
+			w.callback(string(b))
+		}
+		return nil
+	}
+	for _, row := range rows {
+		w.lastSeq = row.Seq
+		if row.Origin != w.id && w.callback != nil {
+			w.callback(row.Message)
+		}
+	}
+	return nil
+}
+
+// DefaultUpdateCallback returns a watcher callback applying the changes to the model of the enforcer
+// incrementally, and rebuilding its role links after a change of roles. The changes are not written to
+// the adapter, the enforcer that made them did already. It reloads the whole policy on Update and
+// UpdateForSavePolicy, or if a change can't be applied.
+// The model is changed under the lock of a SyncedEnforcer.
+func DefaultUpdateCallback(e casbin.IEnforcer) func(string) {
+	return func(msg string) {
+		if err := applyWatcherMessage(e, msg); err != nil {
+			_ = e.LoadPolicy()
+		}
+	}
+}
+
+func applyWatcherMessage(e casbin.IEnforcer, msg string) error {
+	var m WatcherMessage
+	if err := json.Unmarshal([]byte(msg), &m); err != nil {
+		return err
+	}
+	switch m.Op {
+	case "", ChangeOpSave:
+		return e.LoadPolicy()
+	case ChangeOpAdd, ChangeOpRemove, ChangeOpRemoveFiltered, ChangeOpUpdate:
+	default:
+		return errors.Errorf("unsupported watcher message %q", m.Op)
+	}
+
+	if err := applyToModel(e, m); err != nil {
+		return err
+	}
+	if m.Sec == "g" {
+		return e.BuildRoleLinks()
+	}
+	return nil
+}
+
+// applyToModel applies the change of the message to the model of the enforcer.
+func applyToModel(e casbin.IEnforcer, m WatcherMessage) error {
+	if l, ok := e.(interface{ GetLock() *sync.RWMutex }); ok {
+		l.GetLock().Lock()
+		defer l.GetLock().Unlock()
+	}
+
+	model := e.GetModel()
+	ast, err := model.GetAssertion(m.Sec, m.Ptype)
+	if err != nil {
+		return err
+	}
+	switch m.Op {
+	case ChangeOpAdd:
+		_, err = model.AddPoliciesWithAffected(m.Sec, m.Ptype, m.Rules)
+	case ChangeOpRemove:
+		_, err = model.RemovePoliciesWithAffected(m.Sec, m.Ptype, m.Rules)
+	case ChangeOpRemoveFiltered:
+		if m.FieldIndex < 0 || m.FieldIndex+len(m.FieldValues) > len(ast.Tokens) {
+			return errors.Errorf("invalid field index %d for %d field values of %s", m.FieldIndex, len(m.FieldValues), m.Ptype)
+		}
+		_, _, err = model.RemoveFilteredPolicy(m.Sec, m.Ptype, m.FieldIndex, m.FieldValues...)
+	case ChangeOpUpdate:
+		var ok bool
+		if ok, err = model.UpdatePolicies(m.Sec, m.Ptype, m.Rules, m.NewRules); err == nil && !ok {
+			err = errors.Errorf("the updated rules of %s are not in the policy", m.Ptype)
+		}
+	}
+	return err
+}